@@ -3,6 +3,7 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/google/uuid"
 
@@ -20,6 +21,17 @@ var (
  	adminHostname   string
 	workingDirectory   string
 	adminEnabled bool
+	metricsAddress string
+	shutdownTimeout time.Duration
+	drainDelay time.Duration
+	watch stitcher.WatchOptions
+	tracing stitcher.TracingOptions
+	logging stitcher.LoggingOptions
+
+	debugSecret stitcher.Secret
+	debugHost   string
+	debugMode   string
+	debugTTL    time.Duration
 
 	rootCmd = &cobra.Command{
 		Use:   "stitcherd",
@@ -42,11 +54,30 @@ their site from a number of different and disparate parts.`,
 				WorkingDirectory: workingDirectory,
 				AdminHostName: adminHostname,
 				AdminEnabled: adminEnabled,
+				MetricsAddress: metricsAddress,
+				ShutdownTimeout: shutdownTimeout,
+				DrainDelay: drainDelay,
+				Watch: watch,
+				Tracing: tracing,
+				Logging: logging,
 			}
 
 			server.Init().Run(hostConfigFiles)
 		},
 	}
+
+	debugTokenCmd = &cobra.Command{
+		Use:   "debug-token",
+		Short: "Print a Stitcherd-Debug header token",
+		Long:  `Print a token for the Stitcherd-Debug header, rendering a host's pages in debug mode`,
+		Run: func(cmd *cobra.Command, args []string) {
+			secret, err := debugSecret.Bytes()
+			if err != nil {
+				er(err)
+			}
+			fmt.Println(stitcher.DebugToken(secret, debugHost, debugMode, time.Now().Add(debugTTL)))
+		},
+	}
 )
 
 // Execute executes the root command.
@@ -64,8 +95,31 @@ func init() {
 	serverCmd.Flags().StringVar(&adminHostname, "adminhost", "", "Hostname to use for the admin end point.  If blank will use a secure UUID")
 	serverCmd.Flags().StringVar(&workingDirectory, "workingdir", ".", "Workding directory for site files. Defaults to .")
 	serverCmd.Flags().BoolVar(&adminEnabled, "enable-admin", false, "Enable Admin/API enpoint(s)")
+	serverCmd.Flags().StringVar(&metricsAddress, "metrics-listen", "", "Address to serve Prometheus metrics on (eg 127.0.0.1:9090), they're also on the admin host")
+	serverCmd.Flags().DurationVar(&shutdownTimeout, "shutdown-timeout", 15*time.Second, "How long SIGTERM waits for in flight requests to finish")
+	serverCmd.Flags().DurationVar(&drainDelay, "drain-delay", 5*time.Second, "How long SIGTERM keeps serving (but not ready) before draining, for load balancers to notice")
+
+	serverCmd.Flags().BoolVar(&watch.Enabled, "watch", false, "Reload hosts when their --host files (or the templates and files they use) change")
+	serverCmd.Flags().DurationVar(&watch.Debounce, "watch-debounce", 250*time.Millisecond, "How long to wait for changes to settle before reloading")
+	serverCmd.Flags().BoolVar(&watch.LiveReload, "live-reload", false, "With --watch, reload pages that include /_stitcherd/reload.js")
+
+	serverCmd.Flags().StringVar(&tracing.Exporter, "trace-exporter", "", "Export request traces with otlp, stdout or file")
+	serverCmd.Flags().StringVar(&tracing.Endpoint, "trace-endpoint", "", "OTLP (HTTP) endpoint, eg http://localhost:4318.  Defaults to $OTEL_EXPORTER_OTLP_ENDPOINT")
+	serverCmd.Flags().StringVar(&tracing.File, "trace-file", "stitcherd-traces.json", "File the file exporter appends the traces to")
+
+	serverCmd.Flags().StringVar(&logging.Level, "log-level", "info", "Log level: debug, info, warn or error")
+	serverCmd.Flags().StringVar(&logging.Format, "log-format", "logfmt", "Log format: logfmt or json")
+	serverCmd.Flags().StringVar(&logging.AccessLog, "access-log", "", "Also append the access log, in Combined Log Format, to this file")
 
 	rootCmd.AddCommand(serverCmd)
+
+	debugTokenCmd.Flags().StringVar(&debugSecret.Env, "secret-env", "", "Environment variable holding the host's Debug secret")
+	debugTokenCmd.Flags().StringVar(&debugSecret.File, "secret-file", "", "File holding the host's Debug secret")
+	debugTokenCmd.Flags().StringVar(&debugHost, "hostname", "", "Hostname (as configured) the token is for")
+	debugTokenCmd.Flags().StringVar(&debugMode, "mode", stitcher.DebugHTML, "Debug mode: html or json")
+	debugTokenCmd.Flags().DurationVar(&debugTTL, "ttl", time.Hour, "How long the token is valid for")
+
+	rootCmd.AddCommand(debugTokenCmd)
 }
 
 func er(msg interface{}) {
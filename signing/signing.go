@@ -0,0 +1,301 @@
+// Package signing signs requests with a shared secret (HMAC-SHA256) and
+// verifies them, so that backends can check their requests come from stitcherd.
+//
+// A signed request carries two headers:
+//
+//	Content-Digest: sha-256=:<base64 SHA-256 of the body>:
+//	Stitcherd-Signature: keyid="<key id>", ts=<unix time>, nonce="<random>", headers="<name>;<name>", sig="<base64 HMAC>"
+//
+// The HMAC is of these lines, each ending in a newline:
+//
+//	stitcherd-hmac-sha256
+//	<METHOD>
+//	<path and query>
+//	<host>
+//	<ts>
+//	<nonce>
+//	<Content-Digest value>
+//	<name>:<value>    (one line per signed header, lower case name, in order)
+//
+// Backends wrap their handlers with Middleware (or use a Verifier) to reject
+// requests that aren't signed with one of their keys, or that are replayed.
+package signing
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers of a signed request
+const (
+	SignatureHeader = "Stitcherd-Signature"
+	DigestHeader    = "Content-Digest"
+)
+
+const algorithm = "stitcherd-hmac-sha256"
+
+// DefaultMaxSkew is how far a request's timestamp can be from the verifier's clock
+const DefaultMaxSkew = 5 * time.Minute
+
+// Errors returned by Verify
+var (
+	ErrUnsigned     = errors.New("request is not signed")
+	ErrMalformed    = errors.New("malformed signature header")
+	ErrUnknownKey   = errors.New("unknown key id")
+	ErrExpired      = errors.New("signature timestamp out of range")
+	ErrDigest       = errors.New("body does not match digest")
+	ErrBadSignature = errors.New("signature does not match")
+	ErrReplayed     = errors.New("request already seen")
+)
+
+// signatureParams are what a signature covers besides the request itself
+type signatureParams struct {
+	timestamp int64
+	nonce     string
+	names     []string // Of the signed headers
+}
+
+// Sign adds the signature (and digest) headers to req, covering its method,
+// path, query, host, body and the named headers.  The body is read and replaced.
+func Sign(req *http.Request, keyID string, secret []byte, headers []string, now time.Time) error {
+	body, err := readBody(&req.Body)
+	if err != nil {
+		return err
+	}
+
+	if body != nil {
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+
+	req.Header.Set(DigestHeader, digest(body))
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	params := signatureParams{
+		timestamp: now.Unix(),
+		nonce:     base64.RawURLEncoding.EncodeToString(nonce),
+		names:     make([]string, len(headers)),
+	}
+	for i, name := range headers {
+		params.names[i] = strings.ToLower(name)
+	}
+
+	signature := sign(secret, req.Method, req.URL.RequestURI(), host, params, req.Header)
+
+	req.Header.Set(SignatureHeader, fmt.Sprintf(`keyid="%s", ts=%d, nonce="%s", headers="%s", sig="%s"`,
+		keyID, params.timestamp, params.nonce, strings.Join(params.names, ";"), signature))
+
+	return nil
+}
+
+// Verify checks r was signed with the secret for its key id (as returned by
+// keys, nil if there isn't one) within maxSkew of now.  The body is read and
+// replaced.  It doesn't detect replayed requests, a Verifier does.
+func Verify(r *http.Request, keys func(keyID string) []byte, maxSkew time.Duration, now time.Time) error {
+	_, err := verify(r, keys, maxSkew, now)
+	return err
+}
+
+// verify is Verify, also returning the signature header's parameters
+func verify(r *http.Request, keys func(keyID string) []byte, maxSkew time.Duration, now time.Time) (map[string]string, error) {
+	header := r.Header.Get(SignatureHeader)
+	if header == "" {
+		return nil, ErrUnsigned
+	}
+
+	params, err := parseSignature(header)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := keys(params["keyid"])
+	if secret == nil {
+		return nil, ErrUnknownKey
+	}
+
+	timestamp, err := strconv.ParseInt(params["ts"], 10, 64)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	skew := now.Sub(time.Unix(timestamp, 0))
+	if skew > maxSkew || skew < -maxSkew {
+		return nil, ErrExpired
+	}
+
+	body, err := readBody(&r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal([]byte(r.Header.Get(DigestHeader)), []byte(digest(body))) {
+		return nil, ErrDigest
+	}
+
+	signed := signatureParams{timestamp: timestamp, nonce: params["nonce"]}
+	if params["headers"] != "" {
+		signed.names = strings.Split(params["headers"], ";")
+	}
+
+	expected := sign(secret, r.Method, r.URL.RequestURI(), r.Host, signed, r.Header)
+	if !hmac.Equal([]byte(params["sig"]), []byte(expected)) {
+		return nil, ErrBadSignature
+	}
+
+	return params, nil
+}
+
+// Verifier verifies requests as Verify does and also rejects those it has
+// already seen (by their nonce), until they'd have expired anyway
+type Verifier struct {
+	Keys    func(keyID string) []byte
+	MaxSkew time.Duration // Defaults to DefaultMaxSkew
+
+	lock sync.Mutex
+	seen map[string]time.Time // Key id and nonce -> when the request expires
+}
+
+// NewVerifier returns a Verifier for keys (by key id)
+func NewVerifier(keys map[string][]byte) *Verifier {
+	return &Verifier{
+		Keys: func(keyID string) []byte {
+			return keys[keyID]
+		},
+	}
+}
+
+// Verify checks r is signed (see Verify) and hasn't been seen before
+func (verifier *Verifier) Verify(r *http.Request, now time.Time) error {
+	maxSkew := verifier.MaxSkew
+	if maxSkew <= 0 {
+		maxSkew = DefaultMaxSkew
+	}
+
+	verifier.forget(now)
+
+	params, err := verify(r, verifier.Keys, maxSkew, now)
+	if err != nil {
+		return err
+	}
+
+	verifier.lock.Lock()
+	defer verifier.lock.Unlock()
+
+	if verifier.seen == nil {
+		verifier.seen = make(map[string]time.Time)
+	}
+
+	key := params["keyid"] + " " + params["nonce"]
+	if _, ok := verifier.seen[key]; ok {
+		return ErrReplayed
+	}
+
+	timestamp, _ := strconv.ParseInt(params["ts"], 10, 64)
+	verifier.seen[key] = time.Unix(timestamp, 0).Add(maxSkew)
+
+	return nil
+}
+
+// forget drops the requests that have expired by now
+func (verifier *Verifier) forget(now time.Time) {
+	verifier.lock.Lock()
+	defer verifier.lock.Unlock()
+
+	for key, expires := range verifier.seen {
+		if now.After(expires) {
+			delete(verifier.seen, key)
+		}
+	}
+}
+
+// Middleware rejects (with a 401) requests to next that aren't signed with
+// one of keys (by key id), or that are replayed
+func Middleware(keys map[string][]byte, next http.Handler) http.Handler {
+	verifier := NewVerifier(keys)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := verifier.Verify(r, time.Now()); err != nil {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func sign(secret []byte, method, uri, host string, params signatureParams, header http.Header) string {
+	var message strings.Builder
+
+	fmt.Fprintf(&message, "%s\n%s\n%s\n%s\n%d\n%s\n%s\n", algorithm, method, uri, host, params.timestamp, params.nonce,
+		header.Get(DigestHeader))
+	for _, name := range params.names {
+		fmt.Fprintf(&message, "%s:%s\n", name, strings.TrimSpace(strings.Join(header.Values(name), ", ")))
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(message.String()))
+
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func digest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+}
+
+// readBody reads all of *body, replacing it so it can be read again
+func readBody(body *io.ReadCloser) ([]byte, error) {
+	if *body == nil || *body == http.NoBody {
+		return nil, nil
+	}
+
+	b, err := io.ReadAll(*body)
+	(*body).Close()
+	if err != nil {
+		return nil, err
+	}
+
+	*body = io.NopCloser(bytes.NewReader(b))
+	return b, nil
+}
+
+// parseSignature splits a signature header into its (unquoted) parameters
+func parseSignature(header string) (map[string]string, error) {
+	params := make(map[string]string)
+
+	for _, param := range strings.Split(header, ",") {
+		parts := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(parts) != 2 {
+			return nil, ErrMalformed
+		}
+		params[parts[0]] = strings.Trim(parts[1], `"`)
+	}
+
+	for _, required := range []string{"keyid", "ts", "nonce", "sig"} {
+		if params[required] == "" {
+			return nil, ErrMalformed
+		}
+	}
+
+	return params, nil
+}
@@ -0,0 +1,166 @@
+package signing
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testSecret = []byte("0123456789abcdef0123456789abcdef")
+	testNow    = time.Unix(1718000000, 0)
+)
+
+func testKeys(keyID string) []byte {
+	if keyID == "2024-06" {
+		return testSecret
+	}
+	return nil
+}
+
+// signedRequest returns a POST to the backend signed at when
+func signedRequest(t *testing.T, when time.Time) *http.Request {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "http://cart:8080/cart/42?currency=nzd", strings.NewReader(`{"sku":"A1"}`))
+	req.Header.Set("Accept", "text/html")
+
+	if err := Sign(req, "2024-06", testSecret, []string{"Accept"}, when); err != nil {
+		t.Fatal(err)
+	}
+
+	return req
+}
+
+func TestSignVerify(t *testing.T) {
+	req := signedRequest(t, testNow)
+
+	if err := Verify(req, testKeys, DefaultMaxSkew, testNow.Add(time.Minute)); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	// The body can still be read by the handler
+	body, err := io.ReadAll(req.Body)
+	if err != nil || string(body) != `{"sku":"A1"}` {
+		t.Errorf("body = %q, %v", body, err)
+	}
+}
+
+func TestSignVerifyNoBody(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://cart:8080/cart/42", nil)
+	if err := Sign(req, "2024-06", testSecret, nil, testNow); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Verify(req, testKeys, DefaultMaxSkew, testNow); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(req *http.Request)
+		want   error
+	}{
+		{"unsigned", func(req *http.Request) { req.Header.Del(SignatureHeader) }, ErrUnsigned},
+		{"malformed", func(req *http.Request) { req.Header.Set(SignatureHeader, "nonsense") }, ErrMalformed},
+		{"unknown key", func(req *http.Request) {
+			req.Header.Set(SignatureHeader, strings.Replace(req.Header.Get(SignatureHeader), "2024-06", "2023-01", 1))
+		}, ErrUnknownKey},
+		{"body", func(req *http.Request) {
+			req.Body = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"sku":"B2"}`)).Body
+		}, ErrDigest},
+		{"path", func(req *http.Request) { req.URL.Path = "/cart/43" }, ErrBadSignature},
+		{"query", func(req *http.Request) { req.URL.RawQuery = "currency=usd" }, ErrBadSignature},
+		{"method", func(req *http.Request) { req.Method = http.MethodPut }, ErrBadSignature},
+		{"host", func(req *http.Request) { req.Host = "other:8080" }, ErrBadSignature},
+		{"signed header", func(req *http.Request) { req.Header.Set("Accept", "application/json") }, ErrBadSignature},
+		{"nonce", func(req *http.Request) {
+			header := req.Header.Get(SignatureHeader)
+			start := strings.Index(header, `nonce="`) + len(`nonce="`)
+			req.Header.Set(SignatureHeader, header[:start]+"x"+header[start+1:])
+		}, ErrBadSignature},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := signedRequest(t, testNow)
+			test.tamper(req)
+
+			if err := Verify(req, testKeys, DefaultMaxSkew, testNow); !errors.Is(err, test.want) {
+				t.Errorf("Verify = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestVerifyExpired(t *testing.T) {
+	for _, skew := range []time.Duration{-DefaultMaxSkew - time.Second, DefaultMaxSkew + time.Second} {
+		req := signedRequest(t, testNow)
+
+		if err := Verify(req, testKeys, DefaultMaxSkew, testNow.Add(skew)); !errors.Is(err, ErrExpired) {
+			t.Errorf("Verify %v later = %v, want %v", skew, err, ErrExpired)
+		}
+	}
+}
+
+func TestVerifierReplayed(t *testing.T) {
+	verifier := &Verifier{Keys: testKeys}
+
+	req := signedRequest(t, testNow)
+	replayed := req.Clone(req.Context())
+	replayed.Body = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"sku":"A1"}`)).Body
+
+	if err := verifier.Verify(req, testNow); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	if err := verifier.Verify(replayed, testNow.Add(time.Second)); !errors.Is(err, ErrReplayed) {
+		t.Errorf("replayed Verify = %v, want %v", err, ErrReplayed)
+	}
+
+	// An identical request signed separately has its own nonce
+	if err := verifier.Verify(signedRequest(t, testNow), testNow); err != nil {
+		t.Errorf("second request: %v", err)
+	}
+
+	// Once it would have expired, it's forgotten (and rejected as expired)
+	if err := verifier.Verify(replayed, testNow.Add(DefaultMaxSkew+time.Second)); !errors.Is(err, ErrExpired) {
+		t.Errorf("late replay = %v, want %v", err, ErrExpired)
+	}
+	if len(verifier.seen) != 0 {
+		t.Errorf("%d nonces still remembered", len(verifier.seen))
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	handler := Middleware(map[string][]byte{"2024-06": testSecret}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	req := signedRequest(t, time.Now())
+	replayed := req.Clone(req.Context())
+	replayed.Body = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"sku":"A1"}`)).Body
+
+	for _, test := range []struct {
+		name string
+		req  *http.Request
+		want int
+	}{
+		{"signed", req, http.StatusNoContent},
+		{"replayed", replayed, http.StatusUnauthorized},
+		{"unsigned", httptest.NewRequest(http.MethodGet, "http://cart:8080/cart/42", nil), http.StatusUnauthorized},
+	} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, test.req)
+
+		if recorder.Code != test.want {
+			t.Errorf("%s: status %d, want %d", test.name, recorder.Code, test.want)
+		}
+	}
+}
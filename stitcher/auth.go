@@ -0,0 +1,418 @@
+package stitcher
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Session key holding the name of the user logged in with a form
+const sessionUserKey = "_user"
+
+const (
+	loginUserField     = "username"
+	loginPasswordField = "password"
+	loginNextField     = "next"
+
+	// How long successful basic auth logins are remembered (to save bcrypting each request)
+	basicAuthCacheTTL = 5 * time.Minute
+)
+
+type authUserContextKey struct{}
+
+// AuthOptions configures a host's users and which of its paths need them to log in
+type AuthOptions struct {
+	Htpasswd string // Users and (bcrypt) passwords, eg from htpasswd -B
+	Htgroup  string // Groups, one per line as "group: user1 user2"
+
+	Realm string // For basic auth, defaults to the Hostname
+
+	// A fragmented_page route showing the login form, which stitcherd handles
+	// POSTs to.  The form has username, password, _csrf and (optionally) next
+	// fields and loginError is in the context when a login fails.
+	LoginPath  string
+	LogoutPath string // Logs the user out and redirects to ?next= (or /)
+
+	// Requirements by path prefix, for paths whose Route has none
+	Protect map[string]AuthRequirement
+
+	// Logging in with an OpenID Connect provider (the "oidc" Scheme)
+	OIDC *OIDCOptions
+
+	// Logging in with a SAML IdP (the "saml" Scheme)
+	SAML *SAMLOptions
+
+	// Passing the logged in user on to backends
+	Forward ForwardOptions
+
+	users       map[string][]byte
+	dummyHash   []byte // Checked for unknown users, so they take as long as known ones
+	groups      map[string][]string
+	basicLogins sync.Map // sha256(user:password) -> time verified
+}
+
+// AuthRequirement restricts a route to logged in users
+type AuthRequirement struct {
+	Scheme string   // "basic", "form" (logging in at the host's LoginPath), "oidc" or "saml"
+	Groups []string // The user must be in one of these, if any are given
+}
+
+// AuthUser is a logged in user.  Their name and (comma separated) groups are
+// in the fetch context as auth.user and auth.groups, and their claims (from
+// an OIDC provider or SAML IdP) as claims.<name>
+type AuthUser struct {
+	Name   string
+	Groups []string
+	Claims map[string]interface{}
+}
+
+// InGroup returns true if the user is in any of groups
+func (user *AuthUser) InGroup(groups []string) bool {
+	for _, group := range groups {
+		for _, member := range user.Groups {
+			if group == member {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// initAuth loads the host's users and groups
+func (host *Host) initAuth() {
+	auth := host.Auth
+
+	if auth.Realm == "" {
+		auth.Realm = host.Hostname
+	}
+
+	auth.users = make(map[string][]byte)
+	if auth.Htpasswd != "" {
+		err := readColonFile(auth.Htpasswd, func(user, hash string) {
+			if !strings.HasPrefix(hash, "$2") {
+				slog.Warn("Ignoring user: only bcrypt passwords are supported", "user", user, "file", auth.Htpasswd)
+				return
+			}
+			auth.users[user] = []byte(hash)
+		})
+		if err != nil {
+			slog.Error("Error reading htpasswd file", "file", auth.Htpasswd, "error", err)
+		}
+	}
+
+	if len(auth.users) > 0 {
+		cost := bcrypt.DefaultCost
+		for _, hash := range auth.users {
+			if c, err := bcrypt.Cost(hash); err == nil {
+				cost = c
+			}
+			break
+		}
+		auth.dummyHash, _ = bcrypt.GenerateFromPassword([]byte(randomToken()), cost)
+	}
+
+	auth.groups = make(map[string][]string)
+	if auth.Htgroup != "" {
+		err := readColonFile(auth.Htgroup, func(group, members string) {
+			for _, user := range strings.Fields(members) {
+				auth.groups[user] = append(auth.groups[user], group)
+			}
+		})
+		if err != nil {
+			slog.Error("Error reading htgroup file", "file", auth.Htgroup, "error", err)
+		}
+	}
+
+	// Form, OIDC and SAML logins are kept in the session
+	if (auth.LoginPath != "" || auth.OIDC != nil || auth.SAML != nil) && host.Sessions == nil {
+		host.Sessions = &SessionOptions{}
+	}
+
+	if auth.OIDC != nil {
+		host.Router.HandleFunc(OIDCCallbackPath, host.OIDCCallbackHandler)
+	}
+
+	if auth.SAML != nil {
+		host.initSAML()
+	}
+
+	if auth.LogoutPath != "" {
+		host.Router.HandleFunc(auth.LogoutPath, host.LogoutHandler)
+	}
+}
+
+// readColonFile calls fn with the two halves of each "key:value" line of path
+func readColonFile(path string, fn func(key, value string)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		fn(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	return scanner.Err()
+}
+
+// Verify returns the user if password is theirs.  Unknown users take as long
+// (checking a dummy hash) so as not to give away who the users are.
+func (auth *AuthOptions) Verify(name, password string) *AuthUser {
+	hash, ok := auth.users[name]
+	if !ok {
+		if auth.dummyHash != nil {
+			bcrypt.CompareHashAndPassword(auth.dummyHash, []byte(password))
+		}
+		return nil
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return nil
+	}
+
+	return auth.user(name)
+}
+
+// sessionUser returns the user logged in with a form, OIDC or SAML, if any
+func (auth *AuthOptions) sessionUser(session *Session) *AuthUser {
+	switch session.Get(sessionIdPKey) {
+	case "oidc":
+		if auth.OIDC == nil || session.Get(sessionUserKey) == "" {
+			return nil
+		}
+		return claimsSessionUser(session)
+	case "saml":
+		if auth.SAML == nil || session.Get(sessionUserKey) == "" {
+			return nil
+		}
+		return claimsSessionUser(session)
+	}
+
+	return auth.user(session.Get(sessionUserKey))
+}
+
+func (auth *AuthOptions) user(name string) *AuthUser {
+	if _, ok := auth.users[name]; !ok {
+		return nil
+	}
+	return &AuthUser{Name: name, Groups: auth.groups[name]}
+}
+
+// verifyBasic checks basic auth credentials, remembering those that are good for a while
+func (auth *AuthOptions) verifyBasic(name, password string) *AuthUser {
+	key := sha256.Sum256([]byte(name + ":" + password))
+
+	if verified, ok := auth.basicLogins.Load(key); ok && time.Since(verified.(time.Time)) < basicAuthCacheTTL {
+		return auth.user(name)
+	}
+
+	user := auth.Verify(name, password)
+	if user != nil {
+		auth.basicLogins.Store(key, time.Now())
+	}
+	return user
+}
+
+// requirement returns the route's auth requirement, or that of the longest
+// host prefix matching path (or the route's path, for its fragments served
+// elsewhere).  Prefixes match whole path segments, /admin doesn't protect
+// /administrators.
+func (route *Route) requirement(site *Host, path string) *AuthRequirement {
+	// Anyone can get to the login page
+	if site.Auth != nil && path == site.Auth.LoginPath {
+		return nil
+	}
+
+	if route.Auth != nil {
+		return route.Auth
+	}
+
+	if site.Auth == nil {
+		return nil
+	}
+
+	var requirement *AuthRequirement
+	longest := -1
+
+	for prefix := range site.Auth.Protect {
+		matches := pathUnder(path, prefix) || pathUnder(route.Path, prefix)
+		if matches && len(prefix) > longest {
+			r := site.Auth.Protect[prefix]
+			requirement, longest = &r, len(prefix)
+		}
+	}
+
+	return requirement
+}
+
+// pathUnder returns true if path is prefix or (a segment boundary on) below it
+func pathUnder(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// Authorize checks the request meets the route's auth requirement, responding
+// (with a 401, login redirect or 403) and returning false if it doesn't.  The
+// returned request carries the user, if they're logged in.
+func (route *Route) Authorize(site *Host, w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	if site.Auth == nil {
+		return r, true
+	}
+
+	requirement := route.requirement(site, r.URL.Path)
+
+	var user *AuthUser
+	if name, password, ok := r.BasicAuth(); ok {
+		user = site.Auth.verifyBasic(name, password)
+	} else if site.sessionStore != nil {
+		user = site.Auth.sessionUser(site.LoadSession(r))
+	}
+
+	if user != nil {
+		r = r.WithContext(context.WithValue(r.Context(), authUserContextKey{}, user))
+	}
+
+	if requirement == nil {
+		return r, true
+	}
+
+	if user == nil {
+		if requirement.Scheme == "oidc" && site.Auth.OIDC != nil && r.Method == http.MethodGet {
+			site.oidcLogin(w, r)
+		} else if requirement.Scheme == "saml" && site.Auth.SAML != nil && r.Method == http.MethodGet {
+			site.samlLogin(w, r)
+		} else if requirement.Scheme == "form" && site.Auth.LoginPath != "" {
+			login := site.Auth.LoginPath + "?" + url.Values{loginNextField: {r.URL.RequestURI()}}.Encode()
+			http.Redirect(w, r, login, http.StatusSeeOther)
+		} else {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, site.Auth.Realm))
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		}
+		return r, false
+	}
+
+	if len(requirement.Groups) > 0 && !user.InGroup(requirement.Groups) {
+		slog.Info("User not in the required groups", "user", user.Name, "groups", requirement.Groups, "path", r.URL.Path)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return r, false
+	}
+
+	return r, true
+}
+
+// protect wraps handler (eg for static content) with the route's auth requirement
+func (route *Route) protect(site *Host, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r, ok := route.Authorize(site, w, r); ok {
+			handler.ServeHTTP(w, r)
+		}
+	})
+}
+
+// RequestUser returns the user the request was authorized for, if any
+func RequestUser(r *http.Request) *AuthUser {
+	user, _ := r.Context().Value(authUserContextKey{}).(*AuthUser)
+	return user
+}
+
+// LoginHandler checks the credentials POSTed to the login page, logging the
+// user in and redirecting them on, or re-rendering the page with loginError
+func (route *Route) LoginHandler(site *Host, w http.ResponseWriter, r *http.Request) {
+	if route.Throttling(r) {
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxFormSize)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if !verifyCSRF(r) {
+		slog.Warn("CSRF token mismatch", "method", r.Method, "path", r.URL.Path)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	name := r.PostForm.Get(loginUserField)
+	user := site.Auth.Verify(name, r.PostForm.Get(loginPasswordField))
+
+	// The password goes no further (eg to fetches, as form.password)
+	r.PostForm.Del(loginPasswordField)
+	r.Form.Del(loginPasswordField)
+
+	fetchContext := route.FetchContext(site, r)
+
+	if user != nil {
+		session, ok := fetchContext["_session"].(*Session)
+		if !ok {
+			slog.Error("Form login without a session store", "host", site.Hostname)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		session.Renew()
+		session.Set(sessionUserKey, user.Name)
+		if err := site.SaveSession(w, r, fetchContext); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("User logged in", "user", user.Name)
+		http.Redirect(w, r, localRedirect(r.PostForm.Get(loginNextField)), http.StatusSeeOther)
+		return
+	}
+
+	slog.Warn("Failed login", "user", name, "remote_addr", r.RemoteAddr)
+
+	fetchContext["loginError"] = "Invalid username or password"
+	w = withCSRFToken(site, w, r, fetchContext)
+
+	content := route.Page.Render(site, fetchContext)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusUnauthorized)
+	fmt.Fprintln(w, content)
+}
+
+// LogoutHandler logs the user out and redirects them to ?next= (or /)
+func (host *Host) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if host.sessionStore != nil {
+		session := host.LoadSession(r)
+		session.Delete(sessionUserKey)
+		host.SaveSession(w, r, map[string]interface{}{"_session": session})
+	}
+
+	http.Redirect(w, r, localRedirect(r.URL.Query().Get(loginNextField)), http.StatusSeeOther)
+}
+
+// localRedirect returns next if it's a path on this host, otherwise /
+func localRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
@@ -0,0 +1,243 @@
+package stitcher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newAuthHost returns a host with users jane (in staff) and bob, both with
+// the password "secret", and the given routes
+func newAuthHost(t *testing.T, auth *AuthOptions, routes ...Route) *Stitcherd {
+	dir := t.TempDir()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth.Htpasswd = filepath.Join(dir, "htpasswd")
+	auth.Htgroup = filepath.Join(dir, "htgroup")
+	if err := os.WriteFile(auth.Htpasswd, []byte("jane:"+string(hash)+"\nbob:"+string(hash)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(auth.Htgroup, []byte("staff: jane\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	stitcherd := (&Stitcherd{}).Init()
+
+	host := &Host{Hostname: "auth.test", Auth: auth, Routes: routes}
+	host.Init()
+	stitcherd.SetHost(host)
+
+	return stitcherd
+}
+
+func pageRoute(path string, source string) Route {
+	return Route{
+		Path:        path,
+		RespondWith: "fragmented_page",
+		Page:        &FragmentedPage{Fragment: Fragment{Name: path, Fetcher: FragmentFetcher{Source: source}}},
+	}
+}
+
+func TestRouteRequirement(t *testing.T) {
+	site := &Host{Auth: &AuthOptions{
+		LoginPath: "/login",
+		Protect: map[string]AuthRequirement{
+			"/admin":       {Scheme: "basic"},
+			"/admin/staff": {Scheme: "basic", Groups: []string{"staff"}},
+			"/account/":    {Scheme: "form"},
+		},
+	}}
+
+	tests := []struct {
+		path string
+		want string // The matching prefix's first group, or scheme, "" for none
+	}{
+		{"/admin", "basic"},
+		{"/admin/", "basic"},
+		{"/admin/users", "basic"},
+		{"/administrators", ""},
+		{"/admin/staff/list", "staff"},
+		{"/admin/staffing", "basic"},
+		{"/account/", "form"},
+		{"/account/orders", "form"},
+		{"/account", ""},
+		{"/login", ""},
+		{"/", ""},
+	}
+
+	for _, test := range tests {
+		route := &Route{Path: test.path}
+
+		got := ""
+		if requirement := route.requirement(site, test.path); requirement != nil {
+			got = requirement.Scheme
+			if len(requirement.Groups) > 0 {
+				got = requirement.Groups[0]
+			}
+		}
+		if got != test.want {
+			t.Errorf("requirement(%s) = %q, want %q", test.path, got, test.want)
+		}
+	}
+
+	// A route's own requirement comes first
+	own := &Route{Path: "/public", Auth: &AuthRequirement{Scheme: "form"}}
+	if requirement := own.requirement(site, "/public"); requirement == nil || requirement.Scheme != "form" {
+		t.Errorf("route's own requirement %+v", requirement)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	stitcherd := newAuthHost(t, &AuthOptions{
+		Realm: "Test",
+		Protect: map[string]AuthRequirement{
+			"/private": {Scheme: "basic"},
+			"/staff":   {Scheme: "basic", Groups: []string{"staff"}},
+		},
+	}, pageRoute("/private", "<p>{{auth.user}}</p>"), pageRoute("/staff", "<p>staff</p>"), pageRoute("/", "<p>home</p>"))
+
+	tests := []struct {
+		path     string
+		user     string
+		password string
+		want     int
+	}{
+		{"/", "", "", http.StatusOK},
+		{"/private", "", "", http.StatusUnauthorized},
+		{"/private", "jane", "wrong", http.StatusUnauthorized},
+		{"/private", "nobody", "secret", http.StatusUnauthorized},
+		{"/private", "jane", "secret", http.StatusOK},
+		{"/staff", "bob", "secret", http.StatusForbidden},
+		{"/staff", "jane", "secret", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, "http://auth.test"+test.path, nil)
+		if test.user != "" {
+			request.SetBasicAuth(test.user, test.password)
+		}
+
+		recorder := httptest.NewRecorder()
+		stitcherd.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.want {
+			t.Errorf("%s as %q: status %d, want %d", test.path, test.user, recorder.Code, test.want)
+		}
+		if test.want == http.StatusUnauthorized && recorder.Header().Get("WWW-Authenticate") != `Basic realm="Test", charset="UTF-8"` {
+			t.Errorf("%s as %q: WWW-Authenticate %q", test.path, test.user, recorder.Header().Get("WWW-Authenticate"))
+		}
+		if test.path == "/private" && test.want == http.StatusOK && !strings.Contains(recorder.Body.String(), "jane") {
+			t.Errorf("page for jane: %q", recorder.Body.String())
+		}
+	}
+}
+
+func TestFormLogin(t *testing.T) {
+	// What the login page's backend saw of the password
+	var seen []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, r.URL.Query().Get("password"))
+		w.Write([]byte("<p>tips</p>"))
+	}))
+	defer backend.Close()
+
+	login := pageRoute("/login", `<form method="post"><input name="_csrf" value="{{csrfToken}}"></form><p id="error">{{loginError}}</p><div id="tips"></div>`)
+	login.Page.Fragment.Fragments = []Fragment{{
+		Name:               "tips",
+		Fetcher:            FragmentFetcher{Type: "uri", Source: backend.URL + "/tips?password={{form.password}}"},
+		DocumentTransforms: []DocumentTransform{{Type: "replace", ParentSelector: "#tips"}},
+	}}
+
+	stitcherd := newAuthHost(t, &AuthOptions{
+		LoginPath: "/login",
+		Protect:   map[string]AuthRequirement{"/account/": {Scheme: "form"}},
+	}, login, pageRoute("/account/", "<p>hello {{auth.user}}</p>"))
+
+	serve := func(method, target string, form url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		var request *http.Request
+		if form != nil {
+			request = httptest.NewRequest(method, "http://auth.test"+target, strings.NewReader(form.Encode()))
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			request = httptest.NewRequest(method, "http://auth.test"+target, nil)
+		}
+		for _, cookie := range cookies {
+			request.AddCookie(cookie)
+		}
+
+		recorder := httptest.NewRecorder()
+		stitcherd.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	// Sent to log in
+	visit := serve(http.MethodGet, "/account/", nil, nil)
+	if visit.Code != http.StatusSeeOther || visit.Header().Get("Location") != "/login?next=%2Faccount%2F" {
+		t.Fatalf("protected page: status %d, location %q", visit.Code, visit.Header().Get("Location"))
+	}
+
+	token := strings.Repeat("d", 64)
+	csrf := []*http.Cookie{{Name: csrfCookieName, Value: token}}
+
+	// Without the CSRF token
+	if recorder := serve(http.MethodPost, "/login", url.Values{"username": {"jane"}, "password": {"secret"}}, csrf); recorder.Code != http.StatusForbidden {
+		t.Errorf("login without the CSRF token: status %d", recorder.Code)
+	}
+
+	// Wrong password
+	failed := serve(http.MethodPost, "/login", url.Values{"_csrf": {token}, "username": {"jane"}, "password": {"wrong"}}, csrf)
+	if failed.Code != http.StatusUnauthorized || !strings.Contains(failed.Body.String(), "Invalid username or password") {
+		t.Errorf("failed login: status %d, body %q", failed.Code, failed.Body.String())
+	}
+	if len(seen) == 0 {
+		t.Error("login page's backend not fetched")
+	}
+	for _, password := range seen {
+		if password != "" {
+			t.Errorf("backend saw the password %q", password)
+		}
+	}
+
+	// Logged in
+	form := url.Values{"_csrf": {token}, "username": {"jane"}, "password": {"secret"}, "next": {"/account/"}}
+	loggedIn := serve(http.MethodPost, "/login", form, csrf)
+	if loggedIn.Code != http.StatusSeeOther || loggedIn.Header().Get("Location") != "/account/" {
+		t.Fatalf("login: status %d, location %q", loggedIn.Code, loggedIn.Header().Get("Location"))
+	}
+
+	account := serve(http.MethodGet, "/account/", nil, loggedIn.Result().Cookies())
+	if account.Code != http.StatusOK || !strings.Contains(account.Body.String(), "hello jane") {
+		t.Errorf("account page: status %d, body %q", account.Code, account.Body.String())
+	}
+
+	// Elsewhere afterwards is only ever on this host
+	form.Set("next", "//evil.test/")
+	if offsite := serve(http.MethodPost, "/login", form, csrf); offsite.Header().Get("Location") != "/" {
+		t.Errorf("login redirected to %q", offsite.Header().Get("Location"))
+	}
+}
+
+func TestVerifyUnknownUser(t *testing.T) {
+	stitcherd := newAuthHost(t, &AuthOptions{})
+	auth := stitcherd.hosts.Get("auth.test").Auth
+
+	if auth.dummyHash == nil {
+		t.Fatal("no dummy hash to check unknown users against")
+	}
+	if user := auth.Verify("nobody", "secret"); user != nil {
+		t.Errorf("unknown user verified: %+v", user)
+	}
+	if user := auth.Verify("jane", "secret"); user == nil || !user.InGroup([]string{"staff"}) {
+		t.Errorf("jane: %+v", user)
+	}
+}
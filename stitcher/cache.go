@@ -2,6 +2,8 @@ package stitcher
 
 import (
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 
 	"github.com/mailgun/groupcache/v2"
@@ -16,12 +18,20 @@ type FragmentRenderContext struct {
 
 type requestContextKey string
 
-// InitCache sets up the cache service
+// The cache's own address and its peers (including itself)
+var (
+	cacheSelf  string
+	cachePeers []string
+)
+
+// InitCache sets up the cache service, returning once it's listening
 func InitCache() *http.Server {
 
 	// Keep track of peers in our cluster and add our instance to the pool `http://localhost:8080`
 	// TODO pool/service config
-	pool := groupcache.NewHTTPPoolOpts("http://localhost:8080", &groupcache.HTTPPoolOptions{})
+	cacheSelf = "http://localhost:8080"
+	cachePeers = []string{cacheSelf}
+	pool := groupcache.NewHTTPPoolOpts(cacheSelf, &groupcache.HTTPPoolOptions{})
 
 	// TODO Config and Add more peers to the cluster
 	//pool.Set("http://peer1:8080", "http://peer2:8080")
@@ -32,10 +42,15 @@ func InitCache() *http.Server {
 		Handler: pool,
 	}
 
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Start a HTTP server to listen for peer requests from the groupcache
 	go func() {
-		log.Printf("Cache Server Running....\n")
-		if err := server.ListenAndServe(); err != nil {
+		slog.Info("Cache server running", "address", server.Addr)
+		if err := server.Serve(listener); err != http.ErrServerClosed {
 			log.Fatal(err)
 		}
 	}()
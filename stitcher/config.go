@@ -2,8 +2,10 @@ package stitcher
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"regexp"
 )
 
 func ReadHostConfigFile(filename string) (c *Host, err error) {
@@ -13,9 +15,10 @@ func ReadHostConfigFile(filename string) (c *Host, err error) {
 		return nil, err
 	}
 
-	// TODO Unmarshall JSON into Host struct pointer
 	var host Host
-	json.Unmarshal([]byte(content), &host)
+	if err := json.Unmarshal([]byte(content), &host); err != nil {
+		return nil, err
+	}
 
 	return &host, nil
 }
@@ -25,11 +28,57 @@ func NewHostFromFile(file string) (*Host, error) {
 	host, err := ReadHostConfigFile(file)
 
 	if err != nil {
-		log.Printf("Error reading config file '%s': %v", file, err)
+		slog.Error("Error reading config file", "file", file, "error", err)
 		return  nil, err
 	}
 
+	if err := host.Validate(); err != nil {
+		slog.Error("Invalid config file", "file", file, "error", err)
+		return nil, err
+	}
+
 	host.Init()
 	
 	return host, nil
 }
+
+// Validate checks what Init would otherwise panic on or silently ignore
+func (host *Host) Validate() error {
+	if host.Hostname == "" {
+		return fmt.Errorf("missing Hostname")
+	}
+
+	if _, err := regexp.Compile(host.Hostname); err != nil {
+		return fmt.Errorf("invalid Hostname: %v", err)
+	}
+
+	for _, alias := range host.Aliases {
+		if alias == "" {
+			return fmt.Errorf("empty alias")
+		}
+	}
+
+	for _, route := range host.Routes {
+		if route.Path == "" {
+			return fmt.Errorf("route without a Path")
+		}
+
+		switch route.RespondWith {
+		case "fragmented_page":
+			if route.Page == nil {
+				return fmt.Errorf("route '%s' has no Page", route.Path)
+			}
+		case "static_content", "redirect", "proxy":
+		default:
+			return fmt.Errorf("route '%s' has unknown RespondWith '%s'", route.Path, route.RespondWith)
+		}
+
+		switch route.Stream {
+		case "", StreamOutOfOrder, StreamInOrder:
+		default:
+			return fmt.Errorf("route '%s' has unknown Stream '%s'", route.Path, route.Stream)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,28 @@
+package stitcher
+
+import (
+	"testing"
+)
+
+func TestValidateStream(t *testing.T) {
+	for _, test := range []struct {
+		stream string
+		valid  bool
+	}{
+		{"", true},
+		{StreamOutOfOrder, true},
+		{StreamInOrder, true},
+		{"in-order", false},
+	} {
+		host := &Host{Hostname: "stream.test", Routes: []Route{{
+			Path:        "/",
+			RespondWith: "fragmented_page",
+			Page:        &FragmentedPage{},
+			Stream:      test.stream,
+		}}}
+
+		if err := host.Validate(); (err == nil) != test.valid {
+			t.Errorf("Stream %q: %v", test.stream, err)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package stitcher
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// Debug render modes
+const (
+	DebugHTML = "html" // The page, with comments marking each fragment and the render tree at the end
+	DebugJSON = "json" // The render tree, as JSON, instead of the page
+)
+
+// DebugHeader carries a debug token (see DebugToken) to render a page in debug mode
+const DebugHeader = "Stitcherd-Debug"
+
+// DebugParam is the query parameter users in DebugOptions.Groups can render a page in debug mode with
+const DebugParam = "_debug"
+
+// DebugOptions allows pages to be rendered in debug mode, showing how each
+// fragment was rendered.  Debugging is disabled if neither is set.
+type DebugOptions struct {
+	Secret Secret   // Verifies DebugHeader tokens
+	Groups []string // Logged in users in these groups can use ?_debug=html or ?_debug=json
+}
+
+// debugNode is a fragment in the render tree of a page rendered in debug mode
+type debugNode struct {
+	Name     string       `json:"name"`
+	Type     string       `json:"type"`
+	Source   string       `json:"source,omitempty"`
+	CacheKey string       `json:"cacheKey,omitempty"`
+	Cache    string       `json:"cache,omitempty"` // hit or miss
+	Duration string       `json:"duration"`
+	Error    string       `json:"error,omitempty"`
+	Children []*debugNode `json:"children,omitempty"`
+
+	fragment *Fragment
+	lock     sync.Mutex
+}
+
+// DebugToken returns a DebugHeader token for host, rendering its pages in mode until expires
+func DebugToken(secret []byte, host, mode string, expires time.Time) string {
+	timestamp := strconv.FormatInt(expires.Unix(), 10)
+	return mode + "." + timestamp + "." + debugSignature(secret, host, mode, timestamp)
+}
+
+func debugSignature(secret []byte, host, mode, expires string) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "stitcherd-debug\n%s\n%s\n%s\n", host, mode, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// debugMode returns the debug mode the request asks for (and is allowed), if any
+func (host *Host) debugMode(r *http.Request) string {
+	if host.Debug == nil {
+		return ""
+	}
+
+	if token := r.Header.Get(DebugHeader); token != "" && host.Debug.Secret.IsSet() {
+		parts := strings.Split(token, ".")
+		if len(parts) != 3 || !validDebugMode(parts[0]) {
+			return ""
+		}
+
+		expires, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || time.Now().Unix() > expires {
+			return ""
+		}
+
+		secret, err := host.Debug.Secret.Bytes()
+		if err != nil {
+			slog.Error("Debug secret", "host", host.Hostname, "error", err)
+			return ""
+		}
+
+		if !hmac.Equal([]byte(parts[2]), []byte(debugSignature(secret, host.Hostname, parts[0], parts[1]))) {
+			slog.Warn("Invalid debug token", "host", host.Hostname, "remote_addr", r.RemoteAddr)
+			return ""
+		}
+
+		return parts[0]
+	}
+
+	mode := r.URL.Query().Get(DebugParam)
+	if !validDebugMode(mode) || len(host.Debug.Groups) == 0 {
+		return ""
+	}
+
+	if user := RequestUser(r); user != nil && user.InGroup(host.Debug.Groups) {
+		return mode
+	}
+
+	return ""
+}
+
+func validDebugMode(mode string) bool {
+	return mode == DebugHTML || mode == DebugJSON
+}
+
+// DebugRender renders the page in debug mode (never streamed), recording how each fragment was rendered
+func (route *Route) DebugRender(site *Host, mode string, fetchContext map[string]interface{}, w http.ResponseWriter, r *http.Request) {
+	root := &debugNode{Name: route.Path, Type: "route"}
+	fetchContext["_debug"] = root
+
+	start := time.Now()
+	content := route.Page.Render(site, fetchContext)
+	root.Duration = time.Since(start).String()
+
+	site.SaveSession(w, r, fetchContext)
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if mode == DebugJSON {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(root)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintln(w, content)
+	fmt.Fprintf(w, "<!-- stitcherd render tree\n%s-->\n", root.tree(""))
+}
+
+// debugContent is Fragment.Content in debug mode, adding the fragment to the render tree
+func (fragment *Fragment) debugContent(site *Host, contextdata map[string]interface{}, parent *debugNode) (content string, err error) {
+	node := parent.add(fragment)
+
+	start := time.Now()
+	defer func() {
+		node.Duration = time.Since(start).String()
+		if err != nil {
+			node.Error = err.Error()
+		}
+	}()
+
+	if fragment.Cachable() {
+		node.CacheKey = fragment.InterpolatedCacheKey(contextdata)
+		node.Cache = "hit"
+
+		// What's rendered into the cache mustn't have our annotations, so only
+		// the miss is recorded (by FillFragmentCache)
+		cacheContext := copyContext(contextdata)
+		delete(cacheContext, "_debug")
+		cacheContext["_debugFill"] = node
+
+		return fragment.FromCache(site, cacheContext)
+	}
+
+	childContext := copyContext(contextdata)
+	childContext["_debug"] = node
+
+	return fragment.Render(site, childContext)
+}
+
+// debugAnnotate marks where the (just rendered) child will be inserted into doc
+func debugAnnotate(doc *goquery.Document, child *Fragment, contextdata map[string]interface{}) {
+	parent, ok := contextdata["_debug"].(*debugNode)
+	if !ok {
+		return
+	}
+
+	node := parent.child(child)
+	if node == nil {
+		return
+	}
+
+	comment := "<!-- stitcherd: " + strings.ReplaceAll(node.String(), "--", "- -") + " -->"
+
+	for _, transformation := range child.DocumentTransforms {
+		if transformation.ParentSelector != "" {
+			doc.Find(transformation.ParentSelector).BeforeHtml(comment)
+		}
+	}
+}
+
+func (node *debugNode) add(fragment *Fragment) *debugNode {
+	child := &debugNode{
+		Name:     fragmentName(fragment),
+		Type:     fetcherType(fragment),
+		Source:   fragment.Fetcher.Source,
+		fragment: fragment,
+	}
+
+	node.lock.Lock()
+	node.Children = append(node.Children, child)
+	node.lock.Unlock()
+
+	return child
+}
+
+// child returns the node of fragment's last render under node
+func (node *debugNode) child(fragment *Fragment) *debugNode {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	for i := len(node.Children) - 1; i >= 0; i-- {
+		if node.Children[i].fragment == fragment {
+			return node.Children[i]
+		}
+	}
+	return nil
+}
+
+func (node *debugNode) String() string {
+	description := fmt.Sprintf("%s (%s) %s", node.Name, node.Type, node.Duration)
+	if node.Source != "" {
+		description += " source=" + strconv.Quote(node.Source)
+	}
+	if node.CacheKey != "" {
+		description += fmt.Sprintf(" cache=%s key=%s", node.Cache, strconv.Quote(node.CacheKey))
+	}
+	if node.Error != "" {
+		description += " error=" + strconv.Quote(node.Error)
+	}
+	return description
+}
+
+// tree returns the node and its children, one per (indented) line
+func (node *debugNode) tree(indent string) string {
+	tree := indent + strings.ReplaceAll(node.String(), "--", "- -") + "\n"
+	for _, child := range node.Children {
+		tree += child.tree(indent + "  ")
+	}
+	return tree
+}
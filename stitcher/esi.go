@@ -0,0 +1,248 @@
+package stitcher
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+const defaultESIMaxDepth = 3
+
+var (
+	esiComment   = regexp.MustCompile(`(?s)<!--esi(.*?)-->`)
+	esiRemove    = regexp.MustCompile(`(?s)<esi:remove>.*?</esi:remove>`)
+	esiChoose    = regexp.MustCompile(`(?s)<esi:choose>(.*?)</esi:choose>`)
+	esiWhen      = regexp.MustCompile(`(?s)<esi:when\s+test\s*=\s*(?:"([^"]*)"|'([^']*)')\s*>(.*?)</esi:when>`)
+	esiOtherwise = regexp.MustCompile(`(?s)<esi:otherwise>(.*?)</esi:otherwise>`)
+	esiInclude   = regexp.MustCompile(`(?s)<esi:include\s([^>]*?)/?>(?:\s*</esi:include>)?`)
+	esiAttribute = regexp.MustCompile(`([\w-]+)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+	esiVariable  = regexp.MustCompile(`\$\(([\w-]+)\)`)
+)
+
+// ESIOptions configures Edge Side Include processing of a fragment's content.
+// Supported are esi:include (with alt and onerror="continue"), esi:remove,
+// <!--esi ... --> comments and esi:choose/when/otherwise.  $(name) in an
+// include's src or a when's test is the value of name in the fetch context.
+type ESIOptions struct {
+	Enabled bool
+
+	BaseURL  string // Relative include srcs are resolved against this, eg "http://backend:8080"
+	CacheTTL string // If set, includes (not fetched as a user) are cached, keyed by src, for this long
+	MaxDepth int    // How deeply included content is itself processed, defaults to 3
+
+	// Where includes may be fetched from (scheme, host and optional path
+	// prefix, as for inline includes).  Defaults to BaseURL's scheme and host.
+	AllowedSources []string
+}
+
+// ProcessESI resolves the ESI markup in content
+func (fragment *Fragment) ProcessESI(site *Host, content string, contextdata map[string]interface{}) (string, error) {
+	maxDepth := fragment.ESI.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = defaultESIMaxDepth
+	}
+
+	depth, _ := contextdata["_esiDepth"].(int)
+
+	content = esiComment.ReplaceAllString(content, "$1")
+	content = esiRemove.ReplaceAllString(content, "")
+
+	content = esiChoose.ReplaceAllStringFunc(content, func(choose string) string {
+		for _, when := range esiWhen.FindAllStringSubmatch(choose, -1) {
+			if esiTest(when[1]+when[2], contextdata) {
+				return when[3]
+			}
+		}
+		if otherwise := esiOtherwise.FindStringSubmatch(choose); otherwise != nil {
+			return otherwise[1]
+		}
+		return ""
+	})
+
+	var output strings.Builder
+	last := 0
+
+	for _, match := range esiInclude.FindAllStringSubmatchIndex(content, -1) {
+		output.WriteString(content[last:match[0]])
+		last = match[1]
+
+		attributes := esiAttributes(content[match[2]:match[3]])
+
+		var included string
+		var err error
+
+		if depth >= maxDepth {
+			err = fmt.Errorf("maximum include depth (%d) exceeded", maxDepth)
+		} else {
+			included, err = fragment.esiInclude(site, attributes["src"], depth, contextdata)
+			if err != nil && attributes["alt"] != "" {
+				included, err = fragment.esiInclude(site, attributes["alt"], depth, contextdata)
+			}
+		}
+
+		if err != nil {
+			if attributes["onerror"] == "continue" {
+				continue
+			}
+			return "", fmt.Errorf("esi:include '%s': %v", attributes["src"], err)
+		}
+
+		output.WriteString(included)
+	}
+
+	output.WriteString(content[last:])
+
+	return output.String(), nil
+}
+
+// esiInclude fetches (or gets from the cache) src, processing any ESI markup
+// in it, and returns its body's markup
+func (fragment *Fragment) esiInclude(site *Host, src string, depth int, contextdata map[string]interface{}) (string, error) {
+	src = esiVariable.ReplaceAllStringFunc(src, func(variable string) string {
+		return url.QueryEscape(esiValue(variable, contextdata))
+	})
+
+	if strings.Contains(src, "{{") {
+		return "", fmt.Errorf("invalid src")
+	}
+
+	location, err := url.Parse(src)
+	if err != nil {
+		return "", err
+	}
+
+	if !location.IsAbs() {
+		if fragment.ESI.BaseURL == "" {
+			return "", fmt.Errorf("relative src and no BaseURL")
+		}
+
+		base, err := url.Parse(fragment.ESI.BaseURL)
+		if err != nil {
+			return "", err
+		}
+		location = base.ResolveReference(location)
+	}
+
+	if !sourceAllowed(location, fragment.esiAllowedSources()) {
+		return "", fmt.Errorf("src not allowed")
+	}
+
+	include := Fragment{
+		Fetcher: FragmentFetcher{Type: "uri", Source: location.String()},
+		ESI:     fragment.ESI,
+	}
+
+	// Included content gets its own copy of the context to track the depth
+	includeContext := copyContext(contextdata)
+	includeContext["_esiDepth"] = depth + 1
+
+	var content string
+
+	// Includes fetched as the user (with their forwarded headers) may be
+	// personal, so aren't shared through the cache
+	if fragment.ESI.CacheTTL != "" && !forwardsUser(contextdata) {
+		include.CacheKey = "esi:" + location.String()
+		include.CacheTTL = fragment.ESI.CacheTTL
+
+		content, err = include.FromCache(site, includeContext)
+	} else {
+		content, err = include.Render(site, includeContext)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(content))
+	if err != nil {
+		return "", err
+	}
+
+	return doc.Find("body").Html()
+}
+
+// esiAllowedSources returns the sources includes may be fetched from
+func (fragment *Fragment) esiAllowedSources() []string {
+	if len(fragment.ESI.AllowedSources) > 0 {
+		return fragment.ESI.AllowedSources
+	}
+
+	base, err := url.Parse(fragment.ESI.BaseURL)
+	if err != nil || base.Host == "" {
+		return nil
+	}
+
+	return []string{base.Scheme + "://" + base.Host}
+}
+
+func esiAttributes(tag string) map[string]string {
+	attributes := make(map[string]string)
+
+	for _, attribute := range esiAttribute.FindAllStringSubmatch(tag, -1) {
+		attributes[attribute[1]] = attribute[2] + attribute[3]
+	}
+
+	return attributes
+}
+
+// esiValue returns the context value for a $(name) variable
+func esiValue(variable string, contextdata map[string]interface{}) string {
+	name := esiVariable.FindStringSubmatch(variable)[1]
+
+	if value, ok := contextdata[name]; ok && value != nil {
+		return fmt.Sprint(value)
+	}
+
+	return ""
+}
+
+// esiTest evaluates a (simple) esi:when test, eg
+// $(user)=='bob' || $(plan) != 'free' && $(loggedIn)
+func esiTest(test string, contextdata map[string]interface{}) bool {
+	for _, or := range strings.Split(test, "||") {
+		result := true
+
+		for _, and := range strings.Split(or, "&&") {
+			if !esiCondition(strings.TrimSpace(and), contextdata) {
+				result = false
+				break
+			}
+		}
+
+		if result {
+			return true
+		}
+	}
+
+	return false
+}
+
+func esiCondition(condition string, contextdata map[string]interface{}) bool {
+	operand := func(s string) string {
+		s = strings.TrimSpace(s)
+		if esiVariable.MatchString(s) {
+			return esiVariable.ReplaceAllStringFunc(s, func(variable string) string {
+				return esiValue(variable, contextdata)
+			})
+		}
+		return strings.Trim(s, `'"`)
+	}
+
+	if parts := strings.SplitN(condition, "!=", 2); len(parts) == 2 {
+		return operand(parts[0]) != operand(parts[1])
+	}
+
+	if parts := strings.SplitN(condition, "==", 2); len(parts) == 2 {
+		return operand(parts[0]) == operand(parts[1])
+	}
+
+	if strings.HasPrefix(condition, "!") {
+		return !esiCondition(strings.TrimPrefix(condition, "!"), contextdata)
+	}
+
+	value := operand(condition)
+	return value != "" && value != "false" && value != "0"
+}
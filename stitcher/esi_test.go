@@ -0,0 +1,109 @@
+package stitcher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mailgun/groupcache/v2"
+)
+
+func TestESIIncludeSources(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<p>" + r.URL.Path + "</p>"))
+	}))
+	defer backend.Close()
+
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("fetched %s from a source that isn't allowed", r.URL)
+	}))
+	defer other.Close()
+
+	site := &Host{Hostname: "esi.test"}
+	site.Init()
+
+	tests := []struct {
+		options ESIOptions
+		content string
+		want    string
+		fails   bool
+	}{
+		{ESIOptions{BaseURL: backend.URL}, `<esi:include src="/a"/>`, "<p>/a</p>", false},
+		{ESIOptions{BaseURL: backend.URL}, `<esi:include src="` + backend.URL + `/b"/>`, "<p>/b</p>", false},
+		{ESIOptions{BaseURL: backend.URL}, `<esi:include src="` + other.URL + `/c"/>`, "", true},
+		{ESIOptions{}, `<esi:include src="` + backend.URL + `/d"/>`, "", true},
+		{ESIOptions{BaseURL: backend.URL}, `<esi:include src="` + other.URL + `/e" alt="/e"/>`, "<p>/e</p>", false},
+		{ESIOptions{AllowedSources: []string{backend.URL + "/ok/"}}, `<esi:include src="` + backend.URL + `/ok/f"/>`, "<p>/ok/f</p>", false},
+		{ESIOptions{AllowedSources: []string{backend.URL + "/ok/"}}, `<esi:include src="` + backend.URL + `/no/g"/>`, "", true},
+		{ESIOptions{BaseURL: backend.URL}, `<esi:include src="` + other.URL + `/h" onerror="continue"/>`, "", false},
+	}
+
+	for _, test := range tests {
+		fragment := &Fragment{ESI: test.options}
+		fragment.ESI.Enabled = true
+
+		// Just the included body goes in
+		got, err := fragment.ProcessESI(site, "<div>"+test.content+"</div>", map[string]interface{}{})
+		want := "<div>" + test.want + "</div>"
+		if test.fails {
+			want = ""
+		}
+		if (err != nil) != test.fails || got != want {
+			t.Errorf("%s: %q (%v), want %q", test.content, got, err, want)
+		}
+	}
+}
+
+func TestESIMaxDepthContinue(t *testing.T) {
+	site := &Host{Hostname: "esi-depth.test"}
+	site.Init()
+
+	fragment := &Fragment{ESI: ESIOptions{Enabled: true, BaseURL: "http://backend.invalid", MaxDepth: 1}}
+	contextdata := map[string]interface{}{"_esiDepth": 1}
+
+	got, err := fragment.ProcessESI(site, `a<esi:include src="/deep" onerror="continue"/>b`, contextdata)
+	if err != nil || got != "ab" {
+		t.Errorf("onerror=continue include past the depth: %q, %v", got, err)
+	}
+
+	if _, err := fragment.ProcessESI(site, `<esi:include src="/deep"/>`, contextdata); err == nil {
+		t.Error("include past the depth didn't fail")
+	}
+}
+
+func TestESICachedOnlyWithoutUser(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<p>" + r.Header.Get("X-User") + "</p>"))
+	}))
+	defer backend.Close()
+
+	site := &Host{Hostname: "esi-cache.test"}
+	site.Init()
+
+	fragment := &Fragment{ESI: ESIOptions{Enabled: true, BaseURL: backend.URL, CacheTTL: "1m"}}
+
+	render := func(user string) string {
+		contextdata := map[string]interface{}{}
+		if user != "" {
+			contextdata["_forwardHeaders"] = http.Header{"X-User": {user}}
+		}
+
+		got, err := fragment.ProcessESI(site, `<esi:include src="/me"/>`, contextdata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	if jane, bob := render("jane"), render("bob"); jane != "<p>jane</p>" || bob != "<p>bob</p>" {
+		t.Errorf("users' includes %q and %q", jane, bob)
+	}
+
+	// Anonymous includes are shared
+	if first, second := render(""), render(""); first != "<p></p>" || second != first {
+		t.Errorf("anonymous includes %q and %q", first, second)
+	}
+	if stats := site.Cache.CacheStats(groupcache.MainCache); stats.Items != 1 {
+		t.Errorf("%d includes cached, want 1", stats.Items)
+	}
+}
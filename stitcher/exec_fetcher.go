@@ -0,0 +1,184 @@
+package stitcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasttemplate"
+)
+
+const (
+	defaultExecTimeout       = 5 * time.Second
+	defaultExecMaxOutput     = 1 << 20
+	defaultExecMaxConcurrent = 4
+)
+
+// Concurrency limits for "exec" fetchers, keyed by their command and options
+var (
+	execSlotsLock sync.Mutex
+	execSlots     = make(map[string]chan struct{})
+)
+
+// ExecOptions configures the "exec" fetcher type.  The command to run is the
+// fetcher's Source (which isn't interpolated) and is run directly (ie not via
+// a shell).
+type ExecOptions struct {
+	Args []string // Interpolated from the fetch context
+
+	// How the route vars, query, session and auth values (and the PassContext
+	// keys) are passed to the command: "env" (the default) sets
+	// STITCHERD_<KEY> for each, "stdin" writes them as a JSON object
+	ContextVia  string
+	PassContext []string // Other fetch context keys passed, eg from the RouteDataFragment
+
+	Timeout       string // Eg "2s", defaults to 5s
+	MaxOutput     int64  // Maximum bytes read from stdout, defaults to 1MB
+	MaxConcurrent int    // Maximum concurrent runs (by fetchers configured alike), defaults to 4
+}
+
+// FetchExec runs the command src and returns its output.  A non-zero exit,
+// timeout or too much output is an error.
+func (fetcher *FragmentFetcher) FetchExec(src string, contextdata map[string]interface{}) (string, error) {
+	options := fetcher.Exec
+
+	timeout := defaultExecTimeout
+	if options.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(options.Timeout); err != nil {
+			return "", fmt.Errorf("exec '%s': invalid timeout: %v", src, err)
+		}
+	}
+
+	maxOutput := options.MaxOutput
+	if maxOutput <= 0 {
+		maxOutput = defaultExecMaxOutput
+	}
+
+	args := make([]string, len(options.Args))
+	for i, arg := range options.Args {
+		args[i] = fasttemplate.New(arg, "{{", "}}").ExecuteString(contextdata)
+	}
+
+	slots := execSlotsFor(src, options)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	select {
+	case slots <- struct{}{}:
+		defer func() { <-slots }()
+	case <-ctx.Done():
+		return "", fmt.Errorf("exec '%s': timed out waiting to run", src)
+	}
+
+	cmd := exec.CommandContext(ctx, src, args...)
+	cmd.Env = os.Environ()
+
+	stdout := &cappedBuffer{max: maxOutput}
+	stderr := &cappedBuffer{max: 4096}
+
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	// Don't wait on grandchildren still holding stdout after a timeout
+	cmd.WaitDelay = time.Second
+
+	// Only what the request (or the config) provides, the fetch context also
+	// holds our environment and the trace and session internals
+	values := passedContext(contextdata, options.PassContext)
+
+	if options.ContextVia == "stdin" {
+		input, err := json.Marshal(values)
+		if err != nil {
+			return "", err
+		}
+		cmd.Stdin = bytes.NewReader(input)
+	} else {
+		for key, value := range values {
+			cmd.Env = append(cmd.Env, "STITCHERD_"+envName(key)+"="+value)
+		}
+	}
+
+	err := cmd.Run()
+
+	if stdout.exceeded {
+		return "", fmt.Errorf("exec '%s': output exceeded %d bytes", src, maxOutput)
+	}
+
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("exec '%s': timed out after %v", src, timeout)
+		}
+		return "", fmt.Errorf("exec '%s': %v: %s", src, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.String(), nil
+}
+
+// execSlotsFor returns the semaphore limiting concurrent runs of command with
+// options.  Fetchers with the same command and options share one, others
+// (eg with a different MaxConcurrent) have their own.
+func execSlotsFor(command string, options ExecOptions) chan struct{} {
+	key, _ := json.Marshal(struct {
+		Command string
+		Options ExecOptions
+	}{command, options})
+
+	execSlotsLock.Lock()
+	defer execSlotsLock.Unlock()
+
+	slots, ok := execSlots[string(key)]
+	if !ok {
+		max := options.MaxConcurrent
+		if max <= 0 {
+			max = defaultExecMaxConcurrent
+		}
+		slots = make(chan struct{}, max)
+		execSlots[string(key)] = slots
+	}
+
+	return slots
+}
+
+// envName converts a context key into an environment variable name, eg
+// userId => USERID, site-key => SITE_KEY
+func envName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+// cappedBuffer keeps the first max bytes written to it, discarding the rest
+// (rather than failing the write, which would leave the command blocked on a
+// full pipe)
+type cappedBuffer struct {
+	buffer   bytes.Buffer
+	max      int64
+	exceeded bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if int64(b.buffer.Len()+len(p)) > b.max {
+		b.exceeded = true
+		b.buffer.Write(p[:b.max-int64(b.buffer.Len())])
+		return len(p), nil
+	}
+	return b.buffer.Write(p)
+}
+
+func (b *cappedBuffer) String() string {
+	return b.buffer.String()
+}
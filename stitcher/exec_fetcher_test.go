@@ -0,0 +1,104 @@
+package stitcher
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecSlotsPerConfig(t *testing.T) {
+	one := execSlotsFor("/bin/echo", ExecOptions{MaxConcurrent: 1})
+	three := execSlotsFor("/bin/echo", ExecOptions{MaxConcurrent: 3})
+
+	if cap(one) != 1 || cap(three) != 3 {
+		t.Errorf("limits %d and %d, want 1 and 3", cap(one), cap(three))
+	}
+
+	if again := execSlotsFor("/bin/echo", ExecOptions{MaxConcurrent: 1}); again != one {
+		t.Error("fetchers configured alike don't share their limit")
+	}
+}
+
+func TestExecSourceNotInterpolated(t *testing.T) {
+	fetcher := &FragmentFetcher{Type: "exec", Source: "/bin/{{cmd}}", Exec: ExecOptions{Args: []string{"{{arg}}"}}}
+
+	_, _, err := fetcher.FetchSource(nil, map[string]interface{}{"cmd": "echo", "arg": "hi"})
+	if err == nil {
+		t.Error("command interpolated from the fetch context")
+	}
+
+	fetcher.Source = "/bin/echo"
+	content, _, err := fetcher.FetchSource(nil, map[string]interface{}{"arg": "hi"})
+	if err != nil || content != "hi\n" {
+		t.Errorf("echo: %q, %v", content, err)
+	}
+}
+
+func TestExecPassesOnlyRequestContext(t *testing.T) {
+	contextdata := map[string]interface{}{
+		"_request": map[string]interface{}{
+			"vars":  map[string]interface{}{"sku": "abc"},
+			"query": map[string]interface{}{"page": "2", "session_user_id": "1"},
+		},
+		"_trace":          "trace",
+		"session.user_id": "7",
+		"auth.user":       "jane",
+		"password":        "secret",
+		"HOME":            "/root",
+		"region":          "eu",
+	}
+
+	tests := []struct {
+		via  string
+		want []string
+	}{
+		{"env", []string{"STITCHERD_SKU=abc", "STITCHERD_PAGE=2", "STITCHERD_SESSION_USER_ID=7", "STITCHERD_AUTH_USER=jane", "STITCHERD_REGION=eu"}},
+		{"stdin", []string{`"sku":"abc"`, `"page":"2"`, `"session.user_id":"7"`, `"auth.user":"jane"`, `"region":"eu"`}},
+	}
+
+	for _, test := range tests {
+		source := "/usr/bin/env"
+		if test.via == "stdin" {
+			source = "/bin/cat"
+		}
+		fetcher := &FragmentFetcher{Type: "exec", Source: source, Exec: ExecOptions{ContextVia: test.via, PassContext: []string{"region"}}}
+
+		content, _, err := fetcher.FetchSource(nil, contextdata)
+		if err != nil {
+			t.Fatalf("%s: %v", test.via, err)
+		}
+
+		// Our own environment is inherited, only what's passed matters
+		if test.via == "env" {
+			var passed []string
+			for _, line := range strings.Split(content, "\n") {
+				if strings.HasPrefix(line, "STITCHERD_") {
+					passed = append(passed, line)
+				}
+			}
+			content = strings.Join(passed, "\n")
+		}
+
+		for _, want := range test.want {
+			if !strings.Contains(content, want) {
+				t.Errorf("%s: %s not passed", test.via, want)
+			}
+		}
+		for _, unwanted := range []string{"trace", "secret", "PASSWORD", "HOME", "_request", `USER_ID=1`, `"1"`} {
+			if strings.Contains(content, unwanted) {
+				t.Errorf("%s: %s passed", test.via, unwanted)
+			}
+		}
+	}
+}
+
+func TestExecDoesNotWaitForGrandchildren(t *testing.T) {
+	fetcher := &FragmentFetcher{Type: "exec", Source: "/bin/sh", Exec: ExecOptions{Args: []string{"-c", "sleep 30 & echo started"}}}
+
+	start := time.Now()
+	fetcher.FetchSource(nil, map[string]interface{}{})
+
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("waited %v for the command's children", elapsed)
+	}
+}
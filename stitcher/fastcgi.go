@@ -0,0 +1,216 @@
+package stitcher
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A minimal FastCGI (responder role) client, see
+// https://fastcgi-archives.github.io/FastCGI_Specification.html
+
+const (
+	fcgiVersion = 1
+
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+
+	fcgiResponder = 1
+
+	fcgiRequestID = 1 // One request per connection
+
+	fcgiMaxContent = 65535
+)
+
+type fcgiHeader struct {
+	Version       uint8
+	Type          uint8
+	RequestID     uint16
+	ContentLength uint16
+	PaddingLength uint8
+	Reserved      uint8
+}
+
+// fcgiResponse is the parsed (CGI) output of a FastCGI request
+type fcgiResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+	Stderr []byte
+}
+
+// fcgiDo sends a single request to the FastCGI server at network/address and
+// returns its response, which must be no more than maxResponse bytes (of
+// records).
+func fcgiDo(network string, address string, params map[string]string, stdin []byte, timeout time.Duration, maxResponse int64) (*fcgiResponse, error) {
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	writer := bufio.NewWriter(conn)
+
+	// BEGIN_REQUEST: role, flags (0, ie close the connection when done), reserved
+	begin := []byte{0, fcgiResponder, 0, 0, 0, 0, 0, 0}
+	if err := fcgiWriteRecord(writer, fcgiBeginRequest, begin); err != nil {
+		return nil, err
+	}
+
+	if err := fcgiWriteStream(writer, fcgiParams, fcgiEncodeParams(params)); err != nil {
+		return nil, err
+	}
+
+	if err := fcgiWriteStream(writer, fcgiStdin, stdin); err != nil {
+		return nil, err
+	}
+
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	limited := &io.LimitedReader{R: conn, N: maxResponse}
+	reader := bufio.NewReader(limited)
+
+	readError := func(err error) error {
+		if limited.N <= 0 {
+			return fmt.Errorf("fastcgi: response exceeded %d bytes", maxResponse)
+		}
+		return fmt.Errorf("fastcgi: reading response: %v", err)
+	}
+
+	for done := false; !done; {
+		var header fcgiHeader
+		if err := binary.Read(reader, binary.BigEndian, &header); err != nil {
+			return nil, readError(err)
+		}
+
+		content := make([]byte, int(header.ContentLength)+int(header.PaddingLength))
+		if _, err := io.ReadFull(reader, content); err != nil {
+			return nil, readError(err)
+		}
+		content = content[:header.ContentLength]
+
+		switch header.Type {
+		case fcgiStdout:
+			stdout.Write(content)
+		case fcgiStderr:
+			stderr.Write(content)
+		case fcgiEndRequest:
+			done = true
+		}
+	}
+
+	return fcgiParseResponse(stdout.Bytes(), stderr.Bytes())
+}
+
+// fcgiParseResponse splits CGI output into its headers and body
+func fcgiParseResponse(output []byte, stderr []byte) (*fcgiResponse, error) {
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(output)))
+
+	mimeHeader, err := reader.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("fastcgi: invalid response headers: %v", err)
+	}
+
+	body, err := io.ReadAll(reader.R)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &fcgiResponse{
+		Status: http.StatusOK,
+		Header: http.Header(mimeHeader),
+		Body:   body,
+		Stderr: stderr,
+	}
+
+	if status := response.Header.Get("Status"); status != "" {
+		code, err := strconv.Atoi(strings.SplitN(status, " ", 2)[0])
+		if err != nil {
+			return nil, fmt.Errorf("fastcgi: invalid status '%s'", status)
+		}
+		response.Status = code
+	}
+
+	return response, nil
+}
+
+func fcgiWriteRecord(w io.Writer, recordType uint8, content []byte) error {
+	padding := uint8(-len(content) & 7)
+
+	header := fcgiHeader{
+		Version:       fcgiVersion,
+		Type:          recordType,
+		RequestID:     fcgiRequestID,
+		ContentLength: uint16(len(content)),
+		PaddingLength: padding,
+	}
+
+	if err := binary.Write(w, binary.BigEndian, header); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(content); err != nil {
+		return err
+	}
+
+	_, err := w.Write(make([]byte, padding))
+	return err
+}
+
+// fcgiWriteStream writes content as records of recordType, terminated by an empty record
+func fcgiWriteStream(w io.Writer, recordType uint8, content []byte) error {
+	for len(content) > 0 {
+		n := len(content)
+		if n > fcgiMaxContent {
+			n = fcgiMaxContent
+		}
+
+		if err := fcgiWriteRecord(w, recordType, content[:n]); err != nil {
+			return err
+		}
+		content = content[n:]
+	}
+
+	return fcgiWriteRecord(w, recordType, nil)
+}
+
+func fcgiEncodeParams(params map[string]string) []byte {
+	var buffer bytes.Buffer
+
+	for name, value := range params {
+		fcgiEncodeLength(&buffer, len(name))
+		fcgiEncodeLength(&buffer, len(value))
+		buffer.WriteString(name)
+		buffer.WriteString(value)
+	}
+
+	return buffer.Bytes()
+}
+
+func fcgiEncodeLength(buffer *bytes.Buffer, length int) {
+	if length < 128 {
+		buffer.WriteByte(byte(length))
+		return
+	}
+
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(length)|1<<31)
+	buffer.Write(b[:])
+}
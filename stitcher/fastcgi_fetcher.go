@@ -0,0 +1,240 @@
+package stitcher
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasttemplate"
+)
+
+const (
+	defaultFastCGITimeout   = 10 * time.Second
+	defaultFastCGIMaxOutput = 1 << 20
+)
+
+// Params for stitcherd's own values, which request values can't be sent as
+var fastCGIReservedPrefixes = []string{"SESSION_", "AUTH_", "CLAIMS_"}
+
+// HTTP clients for unix:// uri sources, by socket path
+var unixClients sync.Map
+
+// FastCGIOptions configures the "fastcgi" fetcher type.  The fetcher's Source
+// is the server's address and the script path, eg
+// "unix:///run/php-fpm.sock:/fragments/cart.php?id={{id}}" or
+// "tcp://127.0.0.1:9000/fragments/cart.php"
+type FastCGIOptions struct {
+	DocumentRoot string            // Prefixed to the script path for SCRIPT_FILENAME
+	Params       map[string]string // Additional (interpolated) CGI params
+
+	// Fetch context keys (eg from the RouteDataFragment) also sent as
+	// STITCHERD_<KEY>, as well as the route vars, query and session values
+	PassContext []string
+
+	Timeout   string // Eg "2s", defaults to 10s
+	MaxOutput int64  // Maximum bytes read from the server, defaults to 1MB
+}
+
+// SplitSocketSource splits a unix:///socket:/path or tcp://host:port/path
+// source into the network, address and request path (including any query).
+func SplitSocketSource(src string) (network string, address string, requestPath string, err error) {
+	switch {
+	case strings.HasPrefix(src, "unix://"):
+		rest := strings.TrimPrefix(src, "unix://")
+		i := strings.Index(rest, ":")
+		if i < 0 {
+			return "", "", "", fmt.Errorf("invalid unix socket source '%s', expected unix:///path/to/sock:/path", src)
+		}
+		network, address, requestPath = "unix", rest[:i], rest[i+1:]
+	case strings.HasPrefix(src, "tcp://"):
+		rest := strings.TrimPrefix(src, "tcp://")
+		i := strings.Index(rest, "/")
+		if i < 0 {
+			i = len(rest)
+		}
+		network, address, requestPath = "tcp", rest[:i], rest[i:]
+	default:
+		return "", "", "", fmt.Errorf("invalid socket source '%s'", src)
+	}
+
+	if !strings.HasPrefix(requestPath, "/") {
+		requestPath = "/" + requestPath
+	}
+
+	return network, address, requestPath, nil
+}
+
+// unixSocketClient returns a (shared) http.Client that connects to socket
+func unixSocketClient(socket string) *http.Client {
+	if client, ok := unixClients.Load(socket); ok {
+		return client.(*http.Client)
+	}
+
+	dialer := net.Dialer{}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+
+	actual, _ := unixClients.LoadOrStore(socket, client)
+	return actual.(*http.Client)
+}
+
+// FetchFastCGI requests src from a FastCGI server (eg php-fpm) and returns
+// the response body.
+func (fetcher *FragmentFetcher) FetchFastCGI(src string, contextdata map[string]interface{}) (string, error) {
+	options := fetcher.FastCGI
+
+	timeout := defaultFastCGITimeout
+	if options.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(options.Timeout); err != nil {
+			return "", fmt.Errorf("fastcgi: invalid timeout: %v", err)
+		}
+	}
+
+	network, address, requestURI, err := SplitSocketSource(src)
+	if err != nil {
+		return "", err
+	}
+
+	params, err := fetcher.fastCGIParams(requestURI, contextdata)
+	if err != nil {
+		return "", err
+	}
+
+	maxOutput := options.MaxOutput
+	if maxOutput <= 0 {
+		maxOutput = defaultFastCGIMaxOutput
+	}
+
+	response, err := fcgiDo(network, address, params, nil, timeout, maxOutput)
+	if err != nil {
+		return "", err
+	}
+
+	if response.Status != http.StatusOK {
+		return "", fmt.Errorf("status code error: %d %s %s", response.Status, http.StatusText(response.Status),
+			strings.TrimSpace(string(response.Stderr)))
+	}
+
+	return string(response.Body), nil
+}
+
+// fastCGIParams builds the CGI params for requestURI from the fetch context
+// and the incoming request.  The script must be within the DocumentRoot.
+func (fetcher *FragmentFetcher) fastCGIParams(requestURI string, contextdata map[string]interface{}) (map[string]string, error) {
+	scriptName, query := requestURI, ""
+	if i := strings.Index(requestURI, "?"); i >= 0 {
+		scriptName, query = requestURI[:i], requestURI[i+1:]
+	}
+
+	// No dot segments, and (so) nothing outside the DocumentRoot
+	scriptFilename := path.Join(fetcher.FastCGI.DocumentRoot, scriptName)
+	root := strings.TrimSuffix(path.Clean(fetcher.FastCGI.DocumentRoot), "/")
+	if strings.Contains(scriptName+"/", "/../") ||
+		root != "." && !strings.HasPrefix(scriptFilename, root+"/") {
+		return nil, fmt.Errorf("fastcgi: script '%s' is outside the DocumentRoot", scriptName)
+	}
+
+	params := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "stitcherd",
+		"SERVER_PROTOCOL":   "HTTP/1.1",
+		"REQUEST_METHOD":    "GET",
+		"REQUEST_URI":       requestURI,
+		"SCRIPT_NAME":       scriptName,
+		"SCRIPT_FILENAME":   scriptFilename,
+		"DOCUMENT_ROOT":     fetcher.FastCGI.DocumentRoot,
+		"QUERY_STRING":      query,
+		"CONTENT_LENGTH":    "0",
+	}
+
+	// The incoming request
+	if request, ok := contextdata["_request"].(map[string]interface{}); ok {
+		if host, ok := request["host"].(string); ok {
+			params["SERVER_NAME"] = host
+			params["HTTP_HOST"] = host
+		}
+		if remoteAddr, ok := request["remoteAddr"].(string); ok {
+			if ip, _, err := net.SplitHostPort(remoteAddr); err == nil {
+				params["REMOTE_ADDR"] = ip
+			}
+		}
+		if headers, ok := request["headers"].(map[string]interface{}); ok {
+			for name, value := range headers {
+				params["HTTP_"+envName(name)] = fmt.Sprint(value)
+			}
+		}
+	}
+
+	// Only what the request (or the config) provides, the fetch context also
+	// holds our environment
+	for key, value := range passedContext(contextdata, fetcher.FastCGI.PassContext) {
+		params["STITCHERD_"+envName(key)] = value
+	}
+
+	for name, value := range fetcher.FastCGI.Params {
+		params[name] = fasttemplate.New(value, "{{", "}}").ExecuteString(contextdata)
+	}
+
+	return params, nil
+}
+
+// passedContext returns the fetch context values passed to a backend (a
+// FastCGI server or an exec'd command): the route vars, query, session and
+// auth values and the passContext keys.  Route vars and query values that
+// would be sent as a session (or auth or claims) value (eg ?session.user_id=
+// or ?session_user_id=) are dropped.
+func passedContext(contextdata map[string]interface{}, passContext []string) map[string]string {
+	values := make(map[string]string)
+
+	if request, ok := contextdata["_request"].(map[string]interface{}); ok {
+		for _, name := range []string{"vars", "query"} {
+			if fields, ok := request[name].(map[string]interface{}); ok {
+				for key, value := range fields {
+					if s, ok := value.(string); ok && !fastCGIReserved(key) {
+						values[key] = s
+					}
+				}
+			}
+		}
+	}
+
+	for key, value := range contextdata {
+		if s, ok := value.(string); ok {
+			for _, prefix := range []string{"session.", "auth.", "claims."} {
+				if strings.HasPrefix(key, prefix) {
+					values[key] = s
+				}
+			}
+		}
+	}
+
+	for _, key := range passContext {
+		if s, ok := contextdata[key].(string); ok {
+			values[key] = s
+		}
+	}
+
+	return values
+}
+
+// fastCGIReserved returns true if key would be sent as one of stitcherd's own params
+func fastCGIReserved(key string) bool {
+	name := envName(key)
+	for _, prefix := range fastCGIReservedPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package stitcher
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFastCGIContextDropsForgedSessionValues(t *testing.T) {
+	fetcher := &FragmentFetcher{Type: "fastcgi"}
+
+	contextdata := map[string]interface{}{
+		"_request": map[string]interface{}{
+			"query": map[string]interface{}{
+				"session.user_id": "1",
+				"session_role":    "admin",
+				"Auth.User":       "admin",
+				"claims-email":    "victim@example.com",
+				"sku":             "42",
+			},
+		},
+		"session.cart": "3",
+		"SECRET":       "from the environment",
+	}
+
+	params, err := fetcher.fastCGIParams("/cart.php", contextdata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"STITCHERD_SKU": "42", "STITCHERD_SESSION_CART": "3"}
+	for name, value := range params {
+		if strings.HasPrefix(name, "STITCHERD_") && want[name] != value {
+			t.Errorf("%s = %q sent", name, value)
+		}
+	}
+	for name, value := range want {
+		if params[name] != value {
+			t.Errorf("%s = %q, want %q", name, params[name], value)
+		}
+	}
+}
+
+func TestFastCGIScriptWithinDocumentRoot(t *testing.T) {
+	for _, test := range []struct {
+		root       string
+		requestURI string
+		want       string // SCRIPT_FILENAME, "" if refused
+	}{
+		{"/var/www", "/cart.php?id=1", "/var/www/cart.php"},
+		{"/var/www/", "/fragments/cart.php", "/var/www/fragments/cart.php"},
+		{"", "/cart.php", "/cart.php"},
+		{"/var/www", "/../../etc/passwd", ""},
+		{"/var/www", "/fragments/../../tmp/x.php", ""},
+		{"/var/www", "/..", ""},
+		{"", "/../tmp/x.php", ""},
+	} {
+		fetcher := &FragmentFetcher{Type: "fastcgi", FastCGI: FastCGIOptions{DocumentRoot: test.root}}
+
+		params, err := fetcher.fastCGIParams(test.requestURI, map[string]interface{}{})
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%s%s: SCRIPT_FILENAME %s, want refused", test.root, test.requestURI, params["SCRIPT_FILENAME"])
+			}
+		} else if err != nil || params["SCRIPT_FILENAME"] != test.want {
+			t.Errorf("%s%s: SCRIPT_FILENAME %q (%v), want %q", test.root, test.requestURI, params["SCRIPT_FILENAME"], err, test.want)
+		}
+	}
+}
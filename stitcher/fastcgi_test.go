@@ -0,0 +1,91 @@
+package stitcher
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// listenUnix listens on a socket in a (short, for the socket path limit) temporary directory
+func listenUnix(t *testing.T) (net.Listener, string) {
+	dir, err := os.MkdirTemp("", "stitcherd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	socket := filepath.Join(dir, "s.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	return listener, socket
+}
+
+func TestFastCGIRoundTrip(t *testing.T) {
+	listener, socket := listenUnix(t)
+
+	go fcgi.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env := fcgi.ProcessEnv(r)
+
+		switch r.URL.Path {
+		case "/missing.php":
+			w.WriteHeader(http.StatusNotFound)
+		case "/large.php":
+			w.Write([]byte(strings.Repeat("x", 4096)))
+		default:
+			fmt.Fprintf(w, "%s %s id=%s sku=%s %s", env["SCRIPT_FILENAME"], r.URL.Path, r.URL.Query().Get("id"),
+				env["STITCHERD_SKU"], strings.Repeat("y", 70000))
+		}
+	}))
+
+	contextdata := map[string]interface{}{
+		"_request": map[string]interface{}{"query": map[string]interface{}{"sku": "42"}},
+	}
+
+	fetcher := &FragmentFetcher{Type: "fastcgi", FastCGI: FastCGIOptions{DocumentRoot: "/var/www"}}
+
+	// Records are at most 64K, so the body spans several
+	content, err := fetcher.FetchFastCGI("unix://"+socket+":/cart.php?id=7", contextdata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/var/www/cart.php /cart.php id=7 sku=42 "; !strings.HasPrefix(content, want) || len(content) != len(want)+70000 {
+		t.Errorf("content %.60q (%d bytes), want %q and 70000 bytes", content, len(content), want)
+	}
+
+	if _, err := fetcher.FetchFastCGI("unix://"+socket+":/missing.php", contextdata); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("404 response: %v", err)
+	}
+
+	fetcher.FastCGI.MaxOutput = 1024
+	if _, err := fetcher.FetchFastCGI("unix://"+socket+":/large.php", contextdata); err == nil || !strings.Contains(err.Error(), "exceeded") {
+		t.Errorf("oversized response: %v", err)
+	}
+}
+
+func TestFetchURIUnixSocket(t *testing.T) {
+	listener, socket := listenUnix(t)
+
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "<p>%s?%s</p>", r.URL.Path, r.URL.RawQuery)
+	}))
+
+	fetcher := &FragmentFetcher{Type: "uri"}
+
+	content, err := fetcher.FetchURI("unix://"+socket+":/fragments/cart?id=7", map[string]interface{}{})
+	if err != nil || content != "<p>/fragments/cart?id=7</p>" {
+		t.Errorf("content %q, %v", content, err)
+	}
+
+	if _, err := fetcher.FetchURI("unix://"+socket, map[string]interface{}{}); err == nil {
+		t.Error("source without a path accepted")
+	}
+}
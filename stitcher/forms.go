@@ -0,0 +1,323 @@
+package stitcher
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasttemplate"
+)
+
+const (
+	csrfCookieName = "stitcherd_csrf"
+	csrfFieldName  = "_csrf"
+	csrfHeaderName = "X-CSRF-Token"
+
+	maxFormSize = 1 << 20
+
+	defaultFormTimeout = 10 * time.Second
+)
+
+// FormAction handles a route's form submissions (for one HTTP method) by
+// forwarding them to a backend.  The backend's response then either redirects
+// the browser (Post/Redirect/Get) or is stitched into a re-render of the
+// route's page (eg to show validation errors).
+//
+// Submitted values are available in the fetch context as form.<name>, eg
+// {{form.email}}, and the CSRF token to include in forms (as a hidden _csrf
+// field) as {{csrfToken}}.
+type FormAction struct {
+	Backend string            // (Interpolated) URL the form is POSTed to
+	Headers map[string]string // Sent to the backend
+
+	// Where to redirect to (with a 303) after the backend accepts (2xx) the
+	// form.  If blank, a backend redirect (3xx) to a local path is passed on
+	// (others go to /), otherwise the page is re-rendered.
+	RedirectTo string
+
+	// How the backend's response is stitched into the re-rendered page, eg
+	// [{"Type": "replace", "ParentSelector": "#form-errors"}]
+	ResultTransforms []DocumentTransform
+
+	Sign *SigningOptions // Sign the request so the backend can tell it's from us
+
+	SkipCSRF bool   // Don't verify the CSRF token (eg for backends that do)
+	Timeout  string // Eg "5s", defaults to 10s
+}
+
+// HasFormActions returns true if any of the host's routes accept forms (including a login page)
+func (host *Host) HasFormActions() bool {
+	if host.Auth != nil && host.Auth.LoginPath != "" {
+		return true
+	}
+
+	for _, route := range host.Routes {
+		if len(route.Actions) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// csrfPlaceholder stands in for the CSRF token as pages render, and is swapped
+// for the visitor's token as the response is written, so that cached content
+// never holds (and shares) one visitor's token.  It's secret so that content
+// can't ask for the token.  This random one is for hosts without a session
+// Secret (see Host.csrfPlaceholder).
+var csrfPlaceholder = newCSRFPlaceholder()
+
+func newCSRFPlaceholder() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return "stitcherd-csrf-" + hex.EncodeToString(b)
+}
+
+// csrfPlaceholder returns the host's CSRF placeholder.  It's derived from the
+// session Secret, if there is one, so that pages cached by (and fetched from)
+// groupcache peers have the same placeholder.
+func (host *Host) csrfPlaceholder() string {
+	if host.Sessions == nil || !host.Sessions.Secret.IsSet() {
+		return csrfPlaceholder
+	}
+
+	secret, err := host.Sessions.Secret.Bytes()
+	if err != nil {
+		return csrfPlaceholder
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("stitcherd csrf placeholder"))
+	return "stitcherd-csrf-" + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// csrfResponseWriter swaps the CSRF placeholder for the token in what's written
+type csrfResponseWriter struct {
+	http.ResponseWriter
+	placeholder []byte
+	token       []byte
+}
+
+func (w *csrfResponseWriter) Write(b []byte) (int, error) {
+	if _, err := w.ResponseWriter.Write(bytes.ReplaceAll(b, w.placeholder, w.token)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (w *csrfResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap gives http.ResponseController the underlying writer
+func (w *csrfResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withCSRFToken sets {{csrfToken}} (to the placeholder) in the fetch context
+// and returns the writer, putting the request's token in its place, to write
+// the response with
+func withCSRFToken(site *Host, w http.ResponseWriter, r *http.Request, fetchContext map[string]interface{}) http.ResponseWriter {
+	token := CSRFToken(w, r)
+	placeholder := site.csrfPlaceholder()
+	fetchContext["csrfToken"] = placeholder
+	return &csrfResponseWriter{ResponseWriter: w, placeholder: []byte(placeholder), token: []byte(token)}
+}
+
+// CSRFToken returns the request's CSRF token, issuing a new one (as a cookie) if it doesn't have one
+func CSRFToken(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(csrfCookieName); err == nil && len(cookie.Value) == 64 {
+		return cookie.Value
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		slog.Error("Error generating CSRF token", "error", err)
+		return ""
+	}
+	token := hex.EncodeToString(b)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return token
+}
+
+// verifyCSRF checks the submitted token matches the request's cookie
+func verifyCSRF(r *http.Request) bool {
+	cookie, err := r.Cookie(csrfCookieName)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+
+	submitted := r.PostForm.Get(csrfFieldName)
+	if submitted == "" {
+		submitted = r.Header.Get(csrfHeaderName)
+	}
+
+	return subtle.ConstantTimeCompare([]byte(submitted), []byte(cookie.Value)) == 1
+}
+
+// FormHandler forwards the form submitted to the route to action's backend
+func (route *Route) FormHandler(site *Host, action *FormAction, w http.ResponseWriter, r *http.Request) {
+	if route.Throttling(r) {
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxFormSize)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if !action.SkipCSRF && !verifyCSRF(r) {
+		slog.Warn("CSRF token mismatch", "method", r.Method, "path", r.URL.Path)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	fetchContext := route.FetchContext(site, r)
+	w = withCSRFToken(site, w, r, fetchContext)
+
+	status, result, location, err := action.forward(r, fetchContext)
+	if err != nil {
+		slog.Error("Error forwarding form", "request_id", fetchContext["_requestId"], "route", route.Path, "backend", action.Backend, "error", err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	// The backend may have changed the session
+	if session, ok := fetchContext["_session"].(*Session); ok {
+		setSessionContext(fetchContext, session)
+	}
+
+	switch {
+	case status >= 500:
+		slog.Error("Backend error for form", "request_id", fetchContext["_requestId"], "route", route.Path, "backend", action.Backend, "status", status)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+
+	case status >= 200 && status < 300 && action.RedirectTo != "":
+		site.SaveSession(w, r, fetchContext)
+		// Interpolated (eg from the form), so may not be local any more
+		redirectTo := fasttemplate.New(action.RedirectTo, "{{", "}}").ExecuteString(fetchContext)
+		http.Redirect(w, r, localRedirect(redirectTo), http.StatusSeeOther)
+
+	case status >= 300 && status < 400 && location != "":
+		// Only within the site, the backend's own URLs aren't ours
+		site.SaveSession(w, r, fetchContext)
+		http.Redirect(w, r, localRedirect(location), http.StatusSeeOther)
+
+	default:
+		// Re-render the page with the backend's response stitched in (via
+		// the context so that it isn't itself interpolated)
+		fetchContext["_formResult"] = result
+
+		page := FragmentedPage{Fragment: route.Page.Fragment}
+		page.Fragment.CacheKey = ""
+		page.Fragment.Fragments = append(append([]Fragment{}, route.Page.Fragment.Fragments...), Fragment{
+			Fetcher:            FragmentFetcher{Source: "{{_formResult}}"},
+			DocumentTransforms: action.ResultTransforms,
+		})
+
+		content := page.Render(site, fetchContext)
+		site.SaveSession(w, r, fetchContext)
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if status >= 400 {
+			w.WriteHeader(status)
+		}
+		fmt.Fprintln(w, content)
+	}
+}
+
+// forward POSTs the submitted form (less the CSRF token) to the backend,
+// returning its status, body and any redirect location
+func (action *FormAction) forward(r *http.Request, contextdata map[string]interface{}) (int, string, string, error) {
+	timeout := defaultFormTimeout
+	if action.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(action.Timeout); err != nil {
+			return 0, "", "", fmt.Errorf("invalid timeout: %v", err)
+		}
+	}
+
+	form := url.Values{}
+	for name, values := range r.PostForm {
+		if name != csrfFieldName {
+			form[name] = values
+		}
+	}
+
+	backend := fasttemplate.New(action.Backend, "{{", "}}").ExecuteString(contextdata)
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, backend, strings.NewReader(form.Encode()))
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		req.Header.Set("X-Forwarded-For", ip)
+	}
+	for name, value := range action.Headers {
+		req.Header.Set(name, value)
+	}
+	setForwardHeaders(req, contextdata)
+	injectTraceContext(req, contextdata)
+
+	if err := action.Sign.sign(req); err != nil {
+		return 0, "", "", fmt.Errorf("signing request: %v", err)
+	}
+
+	client := &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse // Redirects are for the browser
+		},
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, "", "", err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	UpdateSession(res.Header, contextdata)
+
+	return res.StatusCode, string(body), res.Header.Get("Location"), nil
+}
+
+// allowedMethods lists the methods the route responds to, for the Allow header
+func (route *Route) allowedMethods() string {
+	methods := []string{http.MethodGet, http.MethodHead}
+	for method := range route.Actions {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods[2:])
+	return strings.Join(methods, ", ")
+}
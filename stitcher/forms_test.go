@@ -0,0 +1,133 @@
+package stitcher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestFormCSRFTokenPerVisitor(t *testing.T) {
+	stitcherd := (&Stitcherd{}).Init()
+
+	host := &Host{
+		Hostname: "csrf.test",
+		Routes: []Route{{
+			Path:        "/",
+			RespondWith: "fragmented_page",
+			Page: &FragmentedPage{Fragment: Fragment{
+				Name:     "form",
+				CacheKey: "form",
+				Fetcher:  FragmentFetcher{Source: `<form method="post"><input name="_csrf" value="{{csrfToken}}"></form>`},
+			}},
+			Actions: map[string]*FormAction{"POST": {Backend: "http://backend.invalid/"}},
+		}},
+	}
+	host.Init()
+	stitcherd.SetHost(host)
+
+	// The (cached) form shows each visitor their own token
+	for _, token := range []string{strings.Repeat("a", 64), strings.Repeat("b", 64)} {
+		request := httptest.NewRequest(http.MethodGet, "http://csrf.test/", nil)
+		request.AddCookie(&http.Cookie{Name: csrfCookieName, Value: token})
+
+		recorder := httptest.NewRecorder()
+		stitcherd.ServeHTTP(recorder, request)
+
+		body := recorder.Body.String()
+		if !strings.Contains(body, `value="`+token+`"`) {
+			t.Errorf("page %q doesn't have the visitor's token %s", body, token[:1])
+		}
+		if strings.Contains(body, host.csrfPlaceholder()) {
+			t.Errorf("page %q has the placeholder", body)
+		}
+	}
+}
+
+func TestFormRedirectStaysLocal(t *testing.T) {
+	var location string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if location == "" {
+			return
+		}
+		w.Header().Set("Location", location)
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer backend.Close()
+
+	stitcherd := (&Stitcherd{}).Init()
+
+	host := &Host{
+		Hostname: "redirect.test",
+		Routes: []Route{{
+			Path:        "/",
+			RespondWith: "fragmented_page",
+			Page:        &FragmentedPage{Fragment: Fragment{Name: "form", Fetcher: FragmentFetcher{Source: "<form></form>"}}},
+			Actions:     map[string]*FormAction{"POST": {Backend: backend.URL + "/"}},
+		}},
+	}
+	host.Init()
+	stitcherd.SetHost(host)
+
+	token := strings.Repeat("c", 64)
+
+	tests := []struct {
+		location   string
+		redirectTo string
+		want       string
+	}{
+		{"/thanks?id=1", "", "/thanks?id=1"},
+		{backend.URL + "/thanks", "", "/"},
+		{"https://elsewhere.test/", "", "/"},
+		{"//elsewhere.test/", "", "/"},
+
+		// The backend accepts the form, RedirectTo is interpolated from it
+		{"", "/welcome?next={{form.next}}", "/welcome?next=//elsewhere.test/"},
+		{"", "{{form.next}}", "/"},
+	}
+
+	for _, test := range tests {
+		location = test.location
+		if test.redirectTo != "" {
+			location = ""
+		}
+		host.Routes[0].Actions["POST"].RedirectTo = test.redirectTo
+
+		form := url.Values{csrfFieldName: {token}, "next": {"//elsewhere.test/"}}
+		request := httptest.NewRequest(http.MethodPost, "http://redirect.test/", strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		request.AddCookie(&http.Cookie{Name: csrfCookieName, Value: token})
+
+		recorder := httptest.NewRecorder()
+		stitcherd.ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusSeeOther || recorder.Header().Get("Location") != test.want {
+			t.Errorf("backend Location %q, RedirectTo %q: status %d, Location %q, want %q", test.location, test.redirectTo, recorder.Code, recorder.Header().Get("Location"), test.want)
+		}
+	}
+}
+
+func TestCSRFPlaceholderSharedBySecret(t *testing.T) {
+	newHost := func(secret string) *Host {
+		host := &Host{Hostname: "peer.test"}
+		if secret != "" {
+			host.Sessions = &SessionOptions{Secret: Secret{Value: secret}}
+		}
+		return host
+	}
+
+	// Peers, configured alike, agree on it (and so on cached pages)
+	one, other := newHost("shared").csrfPlaceholder(), newHost("shared").csrfPlaceholder()
+	if one != other {
+		t.Errorf("peers' placeholders %q and %q differ", one, other)
+	}
+
+	if one == newHost("different").csrfPlaceholder() {
+		t.Error("placeholder doesn't depend on the secret")
+	}
+
+	if one == csrfPlaceholder || newHost("").csrfPlaceholder() != csrfPlaceholder {
+		t.Error("hosts without a secret don't use the random placeholder")
+	}
+}
@@ -0,0 +1,161 @@
+package stitcher
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+const defaultForwardJWTTTL = 5 * time.Minute
+
+// ForwardOptions passes the logged in user on to backends (uri, graphql and
+// form action requests) as headers and/or a signed JWT
+type ForwardOptions struct {
+	// Headers to send, with the claims they hold, eg {"X-User-Email": "email"}.
+	// The claims "user" and "groups" are the user's name and (comma separated) groups.
+	Headers map[string]string
+
+	JWT ForwardJWTOptions
+}
+
+// ForwardJWTOptions configures sending the user's claims as a JWT signed (HS256)
+// with a secret (of at least 32 bytes) shared with the backends
+type ForwardJWTOptions struct {
+	Secret   Secret // No JWT is sent unless this is set
+	Header   string // Defaults to Authorization (as "Bearer <jwt>")
+	Issuer   string // Defaults to stitcherd
+	Audience string
+	TTL      string // Eg "1m", defaults to 5m
+}
+
+// forwardHeaders returns the headers that pass user on to backends
+func (auth *AuthOptions) forwardHeaders(user *AuthUser) http.Header {
+	header := make(http.Header)
+
+	for name, claim := range auth.Forward.Headers {
+		if value := user.Claim(claim); value != "" {
+			header.Set(name, value)
+		}
+	}
+
+	if auth.Forward.JWT.Secret.IsSet() {
+		token, err := auth.Forward.JWT.sign(user)
+		if err != nil {
+			slog.Error("Error signing user JWT", "user", user.Name, "error", err)
+			return header
+		}
+
+		if auth.Forward.JWT.Header == "" {
+			header.Set("Authorization", "Bearer "+token)
+		} else {
+			header.Set(auth.Forward.JWT.Header, token)
+		}
+	}
+
+	return header
+}
+
+// Claim returns a claim about the user as a string, "user" and "groups" being
+// their name and (comma separated) groups
+func (user *AuthUser) Claim(claim string) string {
+	switch claim {
+	case "user":
+		return user.Name
+	case "groups":
+		return strings.Join(user.Groups, ",")
+	}
+
+	switch value := user.Claims[claim].(type) {
+	case nil:
+		return ""
+	case []interface{}:
+		values := make([]string, len(value))
+		for i, v := range value {
+			values[i] = fmt.Sprint(v)
+		}
+		return strings.Join(values, ",")
+	case float64:
+		// JSON numbers, printed without an exponent
+		return strings.TrimSuffix(strings.TrimRight(fmt.Sprintf("%f", value), "0"), ".")
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// sign returns a JWT of the user's claims
+func (options *ForwardJWTOptions) sign(user *AuthUser) (string, error) {
+	secret, err := options.Secret.Bytes()
+	if err != nil {
+		return "", err
+	}
+	if len(secret) < 32 {
+		return "", fmt.Errorf("the secret must be at least 32 bytes")
+	}
+
+	ttl := defaultForwardJWTTTL
+	if options.TTL != "" {
+		if ttl, err = time.ParseDuration(options.TTL); err != nil {
+			return "", err
+		}
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: secret},
+		(&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return "", err
+	}
+
+	claims := make(map[string]interface{}, len(user.Claims)+4)
+	for k, v := range user.Claims {
+		claims[k] = v
+	}
+
+	issuer := options.Issuer
+	if issuer == "" {
+		issuer = "stitcherd"
+	}
+
+	now := time.Now()
+	registered := jwt.Claims{
+		Issuer:   issuer,
+		Subject:  user.Name,
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(ttl)),
+	}
+	if options.Audience != "" {
+		registered.Audience = jwt.Audience{options.Audience}
+	}
+	if sub, ok := user.Claims["sub"].(string); ok {
+		registered.Subject = sub
+	}
+
+	claims["user"] = user.Name
+	claims["groups"] = user.Groups
+	delete(claims, "aud")
+	delete(claims, "nonce")
+
+	return jwt.Signed(signer).Claims(claims).Claims(registered).Serialize()
+}
+
+// forwardsUser returns true if fetches with contextdata send the user on to the backend
+func forwardsUser(contextdata map[string]interface{}) bool {
+	header, ok := contextdata["_forwardHeaders"].(http.Header)
+	return ok && len(header) > 0
+}
+
+// setForwardHeaders adds the headers passing the user (in the context) on to a backend
+func setForwardHeaders(req *http.Request, contextdata map[string]interface{}) {
+	header, ok := contextdata["_forwardHeaders"].(http.Header)
+	if !ok {
+		return
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+}
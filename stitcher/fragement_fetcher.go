@@ -11,16 +11,14 @@ import (
 	"net/http"
 	"strings"
 
-	"github.com/Masterminds/sprig"
 	"github.com/PuerkitoBio/goquery"
-	"github.com/bradfitz/iter"
 	"github.com/valyala/fasttemplate"
 )
 
 type FragmentFetcher struct {
 	Type string
 
-	Source string                 // Filepath, URI, static/interpolated string, Cachekey name (For rendered)
+	Source string                 // Filepath, URI, command, DSN, static/interpolated string, Cachekey name (For rendered)
 
 	Template string               // Go template name/path
 	IsJson bool                   // Parse fetched fragment as JSON, Only useful if Template is present.
@@ -29,36 +27,57 @@ type FragmentFetcher struct {
 	URIVerb string                // GET POST PATCH DELETE(?) etc
 	URIParams map[string]string   // Post and Get will be different
 	Headers map[string]string     // Makes sense for remote fragments
-}
 
-func (fetcher *FragmentFetcher) Fetch(contextdata map[string]interface{}) (string, error) {
+	// Sign uri and graphql requests so backends can tell they're from us
+	Sign *SigningOptions
 
-	t := fasttemplate.New(fetcher.Source, "{{", "}}")
-	src := t.ExecuteString(contextdata)
+	// Convert the fetched (file or uri) source from Markdown to HTML.  Front matter
+	// is available to the Template as .meta and as data from Fragment.GetData
+	Markdown bool
+	Highlight string              // Chroma style for code blocks, eg "monokai". Blank for none
+	MarkdownUnsafe bool           // Pass raw HTML in the Markdown through, for trusted sources only
 
-	var fetched_fragment string = src // Default to String source
-	var err error = nil
-	
-	switch fetcher.Type {
-	case "uri":
-		fetched_fragment, err = fetcher.FetchURI(src)
-	case "file":
-		fetched_fragment, err = fetcher.FetchFile(src)
+	// Values for "exec" sources
+	Exec ExecOptions
+
+	// Values for "sql" sources
+	SQL SQLOptions
+
+	// Values for "graphql" sources
+	GraphQL GraphQLOptions
+
+	// Values for "fastcgi" sources
+	FastCGI FastCGIOptions
+}
+
+// Fetch retrieves the fragment's source for site and, if there is one, renders
+// it through the Template. cacheKey is the fragment's interpolated cache key (if
+// any) and is made available to the template.
+func (fetcher *FragmentFetcher) Fetch(site *Host, contextdata map[string]interface{}, cacheKey string) (string, error) {
+
+	fetched_fragment, frontMatter, err := fetcher.FetchSource(site, contextdata)
+	if err != nil {
+		return "", err
 	}
 
 	if fetcher.Template != "" {
 		templateBytes, _ := ioutil.ReadFile(fetcher.Template)
 		templateContents := string(templateBytes)
 
-		funcs := sprig.GenericFuncMap()
-		funcs["N"] = iter.N
-		funcs["unescape"] = unescape
-
-		parsedTemplate := template.Must(template.New(fetcher.Template).Funcs(template.FuncMap(funcs)).Parse(templateContents))
+		parsedTemplate := template.Must(template.New(fetcher.Template).Funcs(TemplateFuncs()).Parse(templateContents))
 
 		var buffer bytes.Buffer
 		var data = make(map[string]interface{})
 
+		data["ctx"] = contextdata
+		data["request"] = contextdata["_request"]
+		data["cacheKey"] = cacheKey
+		data["meta"] = frontMatter
+
+		if session, ok := contextdata["_session"].(*Session); ok {
+			data["session"] = session.Values()
+		}
+
 		if fetcher.IsJson {
 			var jsonData interface{}
 		
@@ -74,6 +93,7 @@ func (fetcher *FragmentFetcher) Fetch(contextdata map[string]interface{}) (strin
 		err = parsedTemplate.Execute(&buffer, data)
 	
 		if err != nil {
+			templateErrors.WithLabelValues(fetcher.Template).Inc()
 			return "", err
 		}
 	
@@ -83,11 +103,76 @@ func (fetcher *FragmentFetcher) Fetch(contextdata map[string]interface{}) (strin
 	return fetched_fragment, nil
 }
 
-func (fetcher *FragmentFetcher) FetchURI(src string) (string, error) {
+// FetchSource retrieves the interpolated Source according to Type, converting
+// it from Markdown if required.  Returns the content and any front matter.
+func (fetcher *FragmentFetcher) FetchSource(site *Host, contextdata map[string]interface{}) (string, map[string]interface{}, error) {
+
+	t := fasttemplate.New(fetcher.Source, "{{", "}}")
+	src := t.ExecuteString(contextdata)
+
+	var fetched_fragment string = src // Default to String source
+	var err error = nil
+
+	switch fetcher.Type {
+	case "uri":
+		fetched_fragment, err = fetcher.FetchURI(src, contextdata)
+	case "file":
+		fetched_fragment, err = fetcher.FetchFile(src)
+	case "exec":
+		// The command isn't interpolated, requests don't choose what's run
+		fetched_fragment, err = fetcher.FetchExec(fetcher.Source, contextdata)
+	case "sql":
+		// The DSN isn't interpolated, requests don't choose the database
+		fetched_fragment, err = fetcher.FetchSQL(site, fetcher.Source, contextdata)
+	case "graphql":
+		fetched_fragment, err = fetcher.FetchGraphQL(src, contextdata)
+	case "fastcgi":
+		fetched_fragment, err = fetcher.FetchFastCGI(src, contextdata)
+	}
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	if fetcher.Markdown {
+		return RenderMarkdown(fetched_fragment, fetcher.Highlight, fetcher.MarkdownUnsafe)
+	}
+
+	return fetched_fragment, nil, nil
+}
+
+func (fetcher *FragmentFetcher) FetchURI(src string, contextdata map[string]interface{}) (string, error) {
 
 	// TODO At somepoint we'll probably need finer grained control over the client/request
 	// not to mention cookie/session handling
-	res, err := http.Get(src)
+	client := http.DefaultClient
+
+	// unix:///path/to/sock:/path requests /path over the socket
+	if strings.HasPrefix(src, "unix://") {
+		_, socket, requestPath, err := SplitSocketSource(src)
+		if err != nil {
+			return "", err
+		}
+		client = unixSocketClient(socket)
+		src = "http://unix" + requestPath
+	}
+
+	req, err := http.NewRequest(http.MethodGet, src, nil)
+	if err != nil {
+		return "", err
+	}
+
+	for name, value := range fetcher.Headers {
+		req.Header.Set(name, value)
+	}
+	setForwardHeaders(req, contextdata)
+	injectTraceContext(req, contextdata)
+
+	if err := fetcher.Sign.sign(req); err != nil {
+		return "", fmt.Errorf("signing request: %v", err)
+	}
+
+	res, err := client.Do(req)
 
 	if err != nil {
 		return "", err
@@ -99,6 +184,9 @@ func (fetcher *FragmentFetcher) FetchURI(src string) (string, error) {
 		return "", fmt.Errorf("status code error: %d %s", res.StatusCode, res.Status)
 	}
 
+	// Backends can change the visitor's session
+	UpdateSession(res.Header, contextdata)
+
 	// Will need to handle/follow redirects - might be an option on the http client
 
 	b, err2 := ioutil.ReadAll(res.Body)
@@ -109,7 +197,3 @@ func (fetcher *FragmentFetcher) FetchFile(src string) (string, error) {
 	b, err := ioutil.ReadFile(src)
 	return string(b), err
 }
-
-func unescape(s string) template.HTML {
-	return template.HTML(s)
-}
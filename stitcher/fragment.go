@@ -4,19 +4,22 @@ import (
 	"context"
 	"encoding/json"
 
-	"log"
+	"log/slog"
 	"strings"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/mailgun/groupcache/v2"
 	"github.com/valyala/fasttemplate"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // Fragments are renderable pieces of markup with one at the top level
 // representing the page being sent to the browser.
 type Fragment struct {
 
+	Name string // Optional, identifies the fragment (eg for live updates)
+
 	Fetcher FragmentFetcher
 
 	Fragments []Fragment // Can be nested 0 or more
@@ -25,6 +28,11 @@ type Fragment struct {
 
 	CacheKey string `json:"cache,optional"`
 	CacheTTL string `json:"ttl,optional"`
+
+	ESI ESIOptions // Process Edge Side Includes in the fetched content
+	Inline InlineOptions // Process includes declared with data-stitch-* attributes
+
+	Live LiveOptions // Push updates of this fragment to open pages
 }
 
 // Caching returns true if we are to use the endpoint
@@ -39,21 +47,48 @@ func (fragment *Fragment) InterpolatedCacheKey(contextData map[string]interface{
 
 }
 
-func (fragment *Fragment) Render(site *Host, contextdata map[string]interface{}) string {
+// Document fetches the fragment's own content (ie without its child Fragments) as a DOM tree
+func (fragment *Fragment) Document(site *Host, contextdata map[string]interface{}) (*goquery.Document, error) {
 
-	var this_content string
-	var this_doc *goquery.Document
-	var err error 
+	fetchContext, span := startSpan(contextdata, "fragment.fetch",
+		attribute.String("fragment.name", fragmentName(fragment)), attribute.String("fetcher.type", fragment.Fetcher.Type))
 
-	this_content, err= fragment.Fetcher.Fetch(contextdata)
+	start := time.Now()
+	this_content, err := fragment.Fetcher.Fetch(site, fetchContext, fragment.InterpolatedCacheKey(contextdata))
+	observeFetch(fragment, start, err)
+	endSpan(span, err)
 
 	if err != nil {
-		return "" // TODO Handle error better.
+		return nil, err
 	}
 
-	this_doc, err = goquery.NewDocumentFromReader(strings.NewReader(this_content))
+	if fragment.ESI.Enabled {
+		this_content, err = fragment.ProcessESI(site, this_content, contextdata)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	this_doc, err := goquery.NewDocumentFromReader(strings.NewReader(this_content))
 	if err != nil {
-		return "" // TODO Handle error better.
+		return nil, err
+	}
+
+	if fragment.Inline.Enabled {
+		fragment.ProcessInlineIncludes(site, this_doc, contextdata)
+	}
+
+	return this_doc, nil
+}
+
+func (fragment *Fragment) Render(site *Host, contextdata map[string]interface{}) (content string, err error) {
+
+	contextdata, span := startSpan(contextdata, "fragment.render", attribute.String("fragment.name", fragmentName(fragment)))
+	defer func() { endSpan(span, err) }()
+
+	this_doc, err := fragment.Document(site, contextdata)
+	if err != nil {
+		return "", err
 	}
 
 
@@ -61,22 +96,24 @@ func (fragment *Fragment) Render(site *Host, contextdata map[string]interface{})
 		var child_content string
 		var child_doc *goquery.Document
 
-		if frag.Cachable() {
-			child_content, err = frag.FromCache(site, contextdata)
-			if err != nil {
-				continue; // Skip on error... TODO Log the error
-			}
-		} else {
-			child_content = frag.Render(site, contextdata)		
+		child_content, err = frag.Content(site, contextdata)
+		debugAnnotate(this_doc, &frag, contextdata)
+		if err != nil {
+			logFragmentError(contextdata, &frag, err)
+			continue; // Skip on error
 		}
 
 		child_doc, err = goquery.NewDocumentFromReader(strings.NewReader(child_content))
 		if err != nil {
-			continue; // Skip on error, TODO log the error
+			logFragmentError(contextdata, &frag, err)
+			continue; // Skip on error
 		}
 
 		for _, transformation := range frag.DocumentTransforms {
+			_, transformSpan := startSpan(contextdata, "fragment.transform",
+				attribute.String("fragment.name", fragmentName(&frag)), attribute.String("transform.type", transformation.Type))
 			transformation.Transform(this_doc, child_doc)
+			transformSpan.End()
 		}
 	}
 
@@ -85,19 +122,35 @@ func (fragment *Fragment) Render(site *Host, contextdata map[string]interface{})
 	}
 
 
-	html, err2 := this_doc.Html()
+	return this_doc.Html()
+}
 
-	if err2 != nil {
-		return "" // TODO Handle error better
+// Content returns the rendered fragment, from the cache if it is Cachable
+func (fragment *Fragment) Content(site *Host, contextdata map[string]interface{}) (string, error) {
+	if node, ok := contextdata["_debug"].(*debugNode); ok {
+		return fragment.debugContent(site, contextdata, node)
 	}
 
-	return html
+	if fragment.Cachable() {
+		return fragment.FromCache(site, contextdata)
+	}
+	return fragment.Render(site, contextdata)
 }
 
-func (fragment *Fragment) GetData(contextdata map[string]interface{}) map[string]interface{} {
+func (fragment *Fragment) GetData(site *Host, contextdata map[string]interface{}) map[string]interface{} {
 	var jsonData map[string]interface{}
+
+	// A Markdown document's data is its front matter
+	if fragment.Fetcher.Markdown {
+		_, frontMatter, err := fragment.Fetcher.FetchSource(site, contextdata)
+		if err != nil {
+			return nil // TODO Handle error better.
+		}
+
+		return frontMatter
+	}
 		
-	fetched_fragment, err := fragment.Fetcher.Fetch(contextdata)
+	fetched_fragment, err := fragment.Fetcher.Fetch(site, contextdata, fragment.InterpolatedCacheKey(contextdata))
 
 	if err != nil {
 		return nil // TODO Handle error better.
@@ -112,14 +165,24 @@ func (fragment *Fragment) FromCache(site *Host, contextdata map[string]interface
 
 	var content string
 
+	cacheKey := fragment.InterpolatedCacheKey(contextdata)
+	contextdata, span := startSpan(contextdata, "cache.get", attribute.String("cache.key", cacheKey))
+
 	var contextvalue = FragmentRenderContext{Site: site, Fragment: fragment, ContextData: contextdata}
-	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), requestContextKey("request"), contextvalue),
+	ctx, cancel := context.WithTimeout(context.WithValue(traceContext(contextdata), requestContextKey("request"), contextvalue),
 		time.Millisecond*2000) // TODO Make this configurable
 
 	defer cancel()
 
-	if err := site.Cache.Get(ctx, fragment.InterpolatedCacheKey(contextdata), groupcache.StringSink(&content)); err != nil {
-		log.Printf("Error getting from cache: %v\n", err)
+	if stats := requestStatsFrom(ctx); stats != nil {
+		stats.cacheGets.Add(1)
+	}
+
+	err := site.Cache.Get(ctx, cacheKey, groupcache.StringSink(&content))
+	endSpan(span, err)
+
+	if err != nil {
+		slog.Error("Error getting from cache", "request_id", contextdata["_requestId"], "key", cacheKey, "error", err)
 		return "", err
 	}
 
@@ -127,29 +190,35 @@ func (fragment *Fragment) FromCache(site *Host, contextdata map[string]interface
 }
 
 func FillFragmentCache(ctx context.Context, id string, dest groupcache.Sink) error {
-	var err error
-
 	v := ctx.Value(requestContextKey("request"))
 
 	r, ok := v.(FragmentRenderContext)
 
 	if ok {
+		if stats := requestStatsFrom(ctx); stats != nil {
+			stats.cacheMisses.Add(1)
+		}
+		if node, ok := r.ContextData["_debugFill"].(*debugNode); ok {
+			node.Cache = "miss"
+		}
+
+		contextdata, span := startSpan(r.ContextData, "cache.fill", attribute.String("cache.key", id))
+		defer span.End()
 
-		content := r.Fragment.Render(r.Site, r.ContextData)
+		content, err := r.Fragment.Render(r.Site, contextdata)
 
 		if err != nil {
-			log.Printf("Error: %v - '%+v'\n", err, r.Fragment)
 			return err
 		}
 
 		ttl, err := time.ParseDuration(r.Fragment.CacheTTL)
 		if err != nil {
-			log.Printf("Error parsing TTL duration: '%v' for key '%s' defaulting to a TTL of one minute\n", err, id)
+			slog.Warn("Invalid cache TTL, defaulting to one minute", "key", id, "ttl", r.Fragment.CacheTTL, "error", err)
 			ttl = time.Minute * 1
 		}
 
 		if err := dest.SetString(content, time.Now().Add(ttl)); err != nil {
-			log.Println("SetString", err)
+			slog.Error("Error caching fragment", "key", id, "error", err)
 			return err
 		}
 	}
@@ -0,0 +1,124 @@
+package stitcher
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/gorilla/mux"
+)
+
+// FragmentPath is where a host's ExposedFragments are served, eg
+// /_fragment/cart?userid=3
+const FragmentPath = "/_fragment/{name}"
+
+// FindFragment returns the named fragment from the host's pages, along with the Route it is on
+func (host *Host) FindFragment(name string) (*Route, *Fragment) {
+	for i := range host.Routes {
+		route := &host.Routes[i]
+
+		if route.Page == nil {
+			continue
+		}
+
+		if fragment := route.Page.Fragment.FindFragment(name); fragment != nil {
+			return route, fragment
+		}
+	}
+
+	return nil, nil
+}
+
+// FindFragment returns the fragment, or one of its descendants, with the given name
+func (fragment *Fragment) FindFragment(name string) *Fragment {
+	if fragment.Name == name {
+		return fragment
+	}
+
+	for i := range fragment.Fragments {
+		if found := fragment.Fragments[i].FindFragment(name); found != nil {
+			return found
+		}
+	}
+
+	return nil
+}
+
+// FragmentHandler renders one of the host's ExposedFragments on its own (eg
+// for htmx/Turbo partial page updates).  The fetch context is built by, and
+// rate limited by, the route the fragment is on.
+func (host *Host) FragmentHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	if !host.fragmentExposed(name) {
+		http.NotFound(w, r)
+		return
+	}
+
+	route, fragment := host.FindFragment(name)
+	if fragment == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	r, ok := route.Authorize(host, w, r)
+	if !ok {
+		return
+	}
+
+	if route.Throttling(r) {
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	// Only the query params, not our own {name}, go in the context
+	fetchContext := route.FetchContext(host, mux.SetURLVars(r, map[string]string{}))
+	if host.HasFormActions() {
+		w = withCSRFToken(host, w, r, fetchContext)
+	}
+
+	content, err := fragment.Content(host, fetchContext)
+	if err != nil {
+		logFragmentError(fetchContext, fragment, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	html, err := fragment.partialHtml(content)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	host.SaveSession(w, r, fetchContext)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, html)
+}
+
+func (host *Host) fragmentExposed(name string) bool {
+	for _, exposed := range host.ExposedFragments {
+		if exposed == name {
+			return true
+		}
+	}
+	return false
+}
+
+// partialHtml returns the markup the fragment inserts into a page: its first
+// replace transform's child selection, or otherwise the body of content
+func (fragment *Fragment) partialHtml(content string) (string, error) {
+	child_doc, err := goquery.NewDocumentFromReader(strings.NewReader(content))
+	if err != nil {
+		return "", err
+	}
+
+	for _, transformation := range fragment.DocumentTransforms {
+		if transformation.Type == "replace" {
+			return transformation.PartialHtml(child_doc)
+		}
+	}
+
+	return child_doc.Find("body").Html()
+}
@@ -9,16 +9,10 @@ type FragmentedPage struct {
 }
 
 func (page *FragmentedPage) Render(site *Host, contextdata map[string]interface{}) string {
-	var err error
-	var content string = ""
-
-	if page.Fragment.Cachable() {
-		content, err = page.Fragment.FromCache(site, contextdata)
-		if err != nil {
-			return "<!-- FRAGMENT ERROR -->" // TODO Make this better
-		}
-	} else {
-		content = page.Fragment.Render(site, contextdata)		
+	content, err := page.Fragment.Content(site, contextdata)
+	if err != nil {
+		logFragmentError(contextdata, &page.Fragment, err)
+		return "<!-- FRAGMENT ERROR -->" // TODO Make this better
 	}
 
 	return content
@@ -0,0 +1,193 @@
+package stitcher
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const defaultGraphQLTimeout = 10 * time.Second
+
+// GraphQLOptions configures the "graphql" fetcher type.  The fetcher's Source
+// is the GraphQL endpoint.
+type GraphQLOptions struct {
+	Query     string // The query document
+	QueryFile string // or a file containing it
+
+	OperationName string // Optional, for documents with more than one operation
+
+	// GraphQL variable name => name of the fetch context value to use
+	Variables map[string]string
+
+	// Send an (Apollo style) persisted query hash, falling back to the full
+	// query if the server doesn't know it yet
+	PersistedQuery bool
+
+	Timeout string // Eg "2s", defaults to 10s
+}
+
+type graphQLRequest struct {
+	Query         string                 `json:"query,omitempty"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+	Extensions    map[string]interface{} `json:"extensions,omitempty"`
+}
+
+type graphQLResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message    string                 `json:"message"`
+		Extensions map[string]interface{} `json:"extensions"`
+	} `json:"errors"`
+}
+
+// FetchGraphQL POSTs the query to endpoint and returns the response's data
+// object as JSON.  Any errors in the response are a fetch error.
+func (fetcher *FragmentFetcher) FetchGraphQL(endpoint string, contextdata map[string]interface{}) (string, error) {
+	options := fetcher.GraphQL
+
+	timeout := defaultGraphQLTimeout
+	if options.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(options.Timeout); err != nil {
+			return "", fmt.Errorf("graphql: invalid timeout: %v", err)
+		}
+	}
+
+	query := options.Query
+	if options.QueryFile != "" {
+		b, err := ioutil.ReadFile(options.QueryFile)
+		if err != nil {
+			return "", err
+		}
+		query = string(b)
+	}
+
+	request := graphQLRequest{Query: query, OperationName: options.OperationName}
+
+	if len(options.Variables) > 0 {
+		request.Variables = make(map[string]interface{})
+		for name, key := range options.Variables {
+			request.Variables[name] = contextdata[key]
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if options.PersistedQuery {
+		hash := sha256.Sum256([]byte(query))
+		request.Extensions = map[string]interface{}{
+			"persistedQuery": map[string]interface{}{
+				"version":    1,
+				"sha256Hash": hex.EncodeToString(hash[:]),
+			},
+		}
+
+		// Try the hash on its own first
+		hashOnly := request
+		hashOnly.Query = ""
+
+		response, err := fetcher.postGraphQL(ctx, endpoint, hashOnly, contextdata)
+		if err != nil {
+			return "", err
+		}
+
+		if !response.persistedQueryNotFound() {
+			return response.result()
+		}
+	}
+
+	response, err := fetcher.postGraphQL(ctx, endpoint, request, contextdata)
+	if err != nil {
+		return "", err
+	}
+
+	return response.result()
+}
+
+func (fetcher *FragmentFetcher) postGraphQL(ctx context.Context, endpoint string, request graphQLRequest,
+	contextdata map[string]interface{}) (*graphQLResponse, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	for name, value := range fetcher.Headers {
+		req.Header.Set(name, value)
+	}
+	setForwardHeaders(req, contextdata)
+	injectTraceContext(req, contextdata)
+
+	if err := fetcher.Sign.sign(req); err != nil {
+		return nil, fmt.Errorf("graphql: signing request: %v", err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var response graphQLResponse
+
+	decodeErr := json.NewDecoder(res.Body).Decode(&response)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		// Some servers answer an unknown persisted query with a 4xx
+		if decodeErr == nil && response.persistedQueryNotFound() {
+			return &response, nil
+		}
+		if decodeErr == nil && len(response.Errors) > 0 {
+			_, err := response.result()
+			return nil, fmt.Errorf("status code error: %d %s: %v", res.StatusCode, res.Status, err)
+		}
+		return nil, fmt.Errorf("status code error: %d %s", res.StatusCode, res.Status)
+	}
+
+	if decodeErr != nil {
+		return nil, fmt.Errorf("graphql: invalid response: %v", decodeErr)
+	}
+
+	return &response, nil
+}
+
+// result returns the data object as JSON, or the errors as an error
+func (response *graphQLResponse) result() (string, error) {
+	if len(response.Errors) > 0 {
+		messages := make([]string, len(response.Errors))
+		for i, e := range response.Errors {
+			messages[i] = e.Message
+		}
+		return "", fmt.Errorf("graphql: %s", strings.Join(messages, "; "))
+	}
+
+	if len(response.Data) == 0 {
+		return "null", nil
+	}
+
+	return string(response.Data), nil
+}
+
+func (response *graphQLResponse) persistedQueryNotFound() bool {
+	for _, e := range response.Errors {
+		if e.Message == "PersistedQueryNotFound" || e.Extensions["code"] == "PERSISTED_QUERY_NOT_FOUND" {
+			return true
+		}
+	}
+	return false
+}
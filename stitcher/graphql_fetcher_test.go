@@ -0,0 +1,121 @@
+package stitcher
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// graphQLStub answers each request with the status and body respond returns
+func graphQLStub(t *testing.T, respond func(request graphQLRequest) (int, string)) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.Header.Get("Content-Type"))
+		}
+
+		var request graphQLRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("decoding request: %v", err)
+		}
+
+		status, body := respond(request)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestFetchGraphQLData(t *testing.T) {
+	server := graphQLStub(t, func(request graphQLRequest) (int, string) {
+		if request.Variables["id"] != "42" {
+			t.Errorf("variables = %v, want id 42", request.Variables)
+		}
+		return http.StatusOK, `{"data":{"product":{"name":"Widget"}}}`
+	})
+
+	fetcher := &FragmentFetcher{GraphQL: GraphQLOptions{
+		Query:     "query($id: ID!) { product(id: $id) { name } }",
+		Variables: map[string]string{"id": "productId"},
+	}}
+
+	data, err := fetcher.FetchGraphQL(server.URL, map[string]interface{}{"productId": "42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data != `{"product":{"name":"Widget"}}` {
+		t.Errorf("data = %s", data)
+	}
+}
+
+func TestFetchGraphQLErrors(t *testing.T) {
+	server := graphQLStub(t, func(request graphQLRequest) (int, string) {
+		return http.StatusOK, `{"data":null,"errors":[{"message":"not found"},{"message":"denied"}]}`
+	})
+
+	fetcher := &FragmentFetcher{GraphQL: GraphQLOptions{Query: "{ product { name } }"}}
+
+	_, err := fetcher.FetchGraphQL(server.URL, map[string]interface{}{})
+	if err == nil || !strings.Contains(err.Error(), "not found; denied") {
+		t.Errorf("err = %v, want the response's errors", err)
+	}
+}
+
+func TestFetchGraphQLStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{"data", http.StatusInternalServerError, `{"data":null}`},
+		{"errors", http.StatusBadRequest, `{"errors":[{"message":"syntax error"}]}`},
+		{"not json", http.StatusBadGateway, `<html>Bad Gateway</html>`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := graphQLStub(t, func(request graphQLRequest) (int, string) {
+				return test.status, test.body
+			})
+
+			fetcher := &FragmentFetcher{GraphQL: GraphQLOptions{Query: "{ product { name } }"}}
+
+			data, err := fetcher.FetchGraphQL(server.URL, map[string]interface{}{})
+			if err == nil || !strings.Contains(err.Error(), "status code error") {
+				t.Errorf("FetchGraphQL = %q, %v, want a status code error", data, err)
+			}
+		})
+	}
+}
+
+func TestFetchGraphQLPersistedQuery(t *testing.T) {
+	var requests []graphQLRequest
+
+	server := graphQLStub(t, func(request graphQLRequest) (int, string) {
+		requests = append(requests, request)
+		if request.Query == "" {
+			return http.StatusBadRequest, `{"errors":[{"message":"PersistedQueryNotFound"}]}`
+		}
+		return http.StatusOK, `{"data":{"ok":true}}`
+	})
+
+	fetcher := &FragmentFetcher{GraphQL: GraphQLOptions{Query: "{ ok }", PersistedQuery: true}}
+
+	data, err := fetcher.FetchGraphQL(server.URL, map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data != `{"ok":true}` {
+		t.Errorf("data = %s", data)
+	}
+
+	if len(requests) != 2 || requests[0].Extensions["persistedQuery"] == nil || requests[1].Query != "{ ok }" {
+		t.Errorf("requests = %+v, want the hash and then the full query", requests)
+	}
+}
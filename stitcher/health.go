@@ -0,0 +1,129 @@
+package stitcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Health end points, served for any Host (and on the metrics listener)
+const (
+	LivenessPath  = "/_stitcherd/healthz"
+	ReadinessPath = "/_stitcherd/ready"
+)
+
+const defaultReadinessTimeout = 2 * time.Second
+
+// ReadinessCheck is a critical backend that must respond (with a status below
+// 400) for stitcherd to be ready
+type ReadinessCheck struct {
+	URL     string
+	Timeout string // Eg "500ms", defaults to 2s
+}
+
+type healthStatus struct {
+	Status   string   `json:"status"`
+	Failures []string `json:"failures,omitempty"`
+}
+
+// isHealthPath returns true for the health end points
+func isHealthPath(path string) bool {
+	return path == LivenessPath || path == ReadinessPath
+}
+
+// HealthHandler serves the liveness and readiness end points
+func (stitcherd *Stitcherd) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	status := healthStatus{Status: "ok"}
+
+	if r.URL.Path == ReadinessPath {
+		status.Failures = stitcherd.readinessFailures(r.Context())
+	}
+
+	code := http.StatusOK
+	if len(status.Failures) > 0 {
+		status.Status = "unavailable"
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
+
+// readinessFailures returns why stitcherd isn't ready, if it isn't
+func (stitcherd *Stitcherd) readinessFailures(ctx context.Context) []string {
+	var failures []string
+
+	if !stitcherd.hostsLoaded.Load() {
+		failures = append(failures, "host configs not loaded")
+	}
+	for _, file := range stitcherd.failedFiles() {
+		failures = append(failures, fmt.Sprintf("host config '%s' failed to load", file))
+	}
+	if !stitcherd.cacheListening.Load() {
+		failures = append(failures, "cache listener not up")
+	}
+	if stitcherd.draining.Load() {
+		failures = append(failures, "shutting down")
+	}
+
+	var checks []ReadinessCheck
+	for _, host := range stitcherd.Hosts() {
+		checks = append(checks, host.Readiness...)
+	}
+
+	results := make([]string, len(checks))
+
+	var wg sync.WaitGroup
+	for i := range checks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := checks[i].check(ctx); err != nil {
+				results[i] = fmt.Sprintf("%s: %v", checks[i].URL, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, result := range results {
+		if result != "" {
+			failures = append(failures, result)
+		}
+	}
+
+	return failures
+}
+
+func (check *ReadinessCheck) check(ctx context.Context) error {
+	timeout := defaultReadinessTimeout
+	if check.Timeout != "" {
+		if parsed, err := time.ParseDuration(check.Timeout); err == nil {
+			timeout = parsed
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, check.URL, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("status %d", res.StatusCode)
+	}
+
+	return nil
+}
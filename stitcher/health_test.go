@@ -0,0 +1,60 @@
+package stitcher
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHealthAndLivePaths(t *testing.T) {
+	stitcherd := (&Stitcherd{}).Init()
+
+	host := &Host{
+		Hostname: "live.test",
+		Routes: []Route{{
+			Path:        "/",
+			RespondWith: "fragmented_page",
+			Page: &FragmentedPage{Fragment: Fragment{
+				Name:    "clock",
+				Fetcher: FragmentFetcher{Source: "<p>tick</p>"},
+				Live:    LiveOptions{Interval: "1s"},
+			}},
+		}},
+	}
+	host.Init()
+	stitcherd.SetHost(host)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, "http://live.test"+path, nil)
+		recorder := httptest.NewRecorder()
+		stitcherd.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	liveness := get(LivenessPath)
+	if liveness.Code != http.StatusOK {
+		t.Fatalf("%s: status %d", LivenessPath, liveness.Code)
+	}
+
+	var status healthStatus
+	if err := json.NewDecoder(liveness.Body).Decode(&status); err != nil || status.Status != "ok" {
+		t.Fatalf("%s: unexpected body %q (%v)", LivenessPath, liveness.Body.String(), err)
+	}
+
+	// Without a page path the live end point rejects the request, rather
+	// than it being answered by the health check
+	live := get(LivePath)
+	if live.Code != http.StatusBadRequest {
+		t.Errorf("%s: status %d, want %d", LivePath, live.Code, http.StatusBadRequest)
+	}
+	if strings.Contains(live.Body.String(), `"status"`) {
+		t.Errorf("%s: answered by the health check: %q", LivePath, live.Body.String())
+	}
+
+	// Not loaded by Run, so not ready
+	if readiness := get(ReadinessPath); readiness.Code != http.StatusServiceUnavailable {
+		t.Errorf("%s: status %d, want %d", ReadinessPath, readiness.Code, http.StatusServiceUnavailable)
+	}
+}
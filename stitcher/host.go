@@ -1,8 +1,13 @@
 package stitcher
 
 import (
+	"database/sql"
+	"fmt"
+	"net/http"
 	"regexp"
-	
+	"sync"
+	"time"
+
 	"github.com/gorilla/mux"
 
 	"github.com/mailgun/groupcache/v2"
@@ -12,6 +17,18 @@ import (
 type Host struct {
 	Hostname string 
 
+	// Other names (matched exactly, with or without a port) the host serves
+	Aliases []string
+
+	// Hosts are matched highest Priority first.  Within a Priority exact
+	// names (the Hostname or an alias) come first, then the longest patterns,
+	// then the longest literal Hostnames (every Hostname is a regular
+	// expression, eg example.com also matches www.example.com).
+	Priority int
+
+	// Serve requests that no host matches
+	Default bool
+
 	Routes []Route 
 
 	Cache    *groupcache.Group
@@ -19,7 +36,63 @@ type Host struct {
 
 	Router *mux.Router
 
+	// Maximum open connections per database used by "sql" fetchers
+	MaxDBConnections int
+
+	// Names of the fragments that can be rendered on their own at FragmentPath
+	ExposedFragments []string
+
+	// Maximum open live fragment update streams, defaults to 1000
+	MaxLiveStreams int
+
+	// Visitor sessions, disabled if nil
+	Sessions *SessionOptions
+
+	// Users and the paths they need to log in to, disabled if nil
+	Auth *AuthOptions
+
+	// Who can render pages in debug mode, disabled if nil
+	Debug *DebugOptions
+
+	// Critical backends that must respond for stitcherd to be ready
+	Readiness []ReadinessCheck
+
 	hostPattern *regexp.Regexp
+
+	// The fragmented_page Routes, by their mux route
+	pageRoutes map[*mux.Route]*Route
+
+	databases     map[string]*sql.DB
+	databasesLock sync.Mutex
+	closed        bool // The databases have been closed, with databasesLock
+
+	// Requests being served, a replaced host is closed after the last one
+	requests     int
+	closing      bool
+	requestsLock sync.Mutex
+
+	sessionStore  sessionStore
+	sessionMaxAge time.Duration
+
+	// Open live update streams and the watchers they share, with liveLock
+	liveStreams  int
+	liveWatchers map[string]*liveWatcher
+	liveLock     sync.Mutex
+}
+
+// maxCache returns the size of the host's cache, 16MB unless MaxCache is set
+func (host *Host) maxCache() int64 {
+	if host.MaxCache == 0 {
+		return 1 << 24
+	}
+	return host.MaxCache
+}
+
+// emptyCache gives the host a new, empty, cache group in place of the one it
+// shares with the host it's replacing, which keeps its own until it goes
+func (host *Host) emptyCache() {
+	groupcache.DeregisterGroup(host.Hostname)
+	host.Cache = groupcache.NewGroup(host.Hostname, host.maxCache(), groupcache.GetterFunc(FillFragmentCache))
 }
 
 // Init handles host specific initialization
@@ -28,10 +101,7 @@ func (host *Host) Init() {
 	// Treat HostName as a regular expression 
 	host.hostPattern = regexp.MustCompile(host.Hostname)
 
-	maxCache := host.MaxCache
-	if maxCache == 0 {
-		maxCache = 1 << 24
-	}
+	maxCache := host.maxCache()
 
 	host.Router = mux.NewRouter()
 
@@ -44,12 +114,135 @@ func (host *Host) Init() {
 			maxCache, groupcache.GetterFunc(FillFragmentCache))
 	}
 
-	for _, r := range host.Routes {
-		r.Init(host)
+	host.pageRoutes = make(map[*mux.Route]*Route)
+
+	if host.Auth != nil {
+		host.initAuth()
+	}
+
+	if host.Sessions != nil {
+		host.initSessions()
+	}
+
+	// Host wide end points go first so that catch all routes don't hide them
+	if host.HasLiveFragments() {
+		host.Router.HandleFunc(LivePath, host.LiveHandler)
+		host.Router.HandleFunc(LiveScriptPath, LiveScriptHandler)
+	}
+
+	if len(host.ExposedFragments) > 0 {
+		host.Router.HandleFunc(FragmentPath, host.FragmentHandler)
+	}
+
+	// Initialise in place so the routes' limiters are shared with our handlers
+	for i := range host.Routes {
+		host.Routes[i].Init(host)
 	}	
 }
 
+// PageRoute returns the fragmented_page Route matching r along with a copy
+// of r carrying the route's mux vars, or nil if there isn't one.
+func (host *Host) PageRoute(r *http.Request) (*Route, *http.Request) {
+	var match mux.RouteMatch
+
+	if !host.Router.Match(r, &match) {
+		return nil, r
+	}
+
+	route, ok := host.pageRoutes[match.Route]
+	if !ok {
+		return nil, r
+	}
+
+	return route, mux.SetURLVars(r, match.Vars)
+}
+
 func (host *Host) Match(hostname string) bool {
 	return host.hostPattern.MatchString(hostname)
 }
 
+// Database returns the host's connection pool for driver/dsn, opening it on first use
+func (host *Host) Database(driver string, dsn string) (*sql.DB, error) {
+	host.databasesLock.Lock()
+	defer host.databasesLock.Unlock()
+
+	if host.closed {
+		return nil, fmt.Errorf("host '%s' is closed", host.Hostname)
+	}
+
+	key := driver + ":" + dsn
+
+	if db, ok := host.databases[key]; ok {
+		return db, nil
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	maxConnections := host.MaxDBConnections
+	if maxConnections == 0 {
+		maxConnections = 4
+	}
+	db.SetMaxOpenConns(maxConnections)
+	db.SetMaxIdleConns(maxConnections)
+
+	if host.databases == nil {
+		host.databases = make(map[string]*sql.DB)
+	}
+	host.databases[key] = db
+
+	return db, nil
+}
+
+// Close releases resources (ie database connections) held by the host, once
+// the requests it's serving have finished
+func (host *Host) Close() {
+	host.requestsLock.Lock()
+	host.closing = true
+	idle := host.requests == 0
+	host.requestsLock.Unlock()
+
+	if idle {
+		host.closeDatabases()
+	}
+}
+
+// acquire counts a request the host is to serve, returning false if it's
+// been closed (ie replaced) and mustn't serve any more
+func (host *Host) acquire() bool {
+	host.requestsLock.Lock()
+	defer host.requestsLock.Unlock()
+
+	if host.closing {
+		return false
+	}
+	host.requests++
+	return true
+}
+
+// release ends a request counted by acquire, closing the host after the last
+// one if it has been closed meanwhile
+func (host *Host) release() {
+	host.requestsLock.Lock()
+	host.requests--
+	idle := host.closing && host.requests == 0
+	host.requestsLock.Unlock()
+
+	if idle {
+		host.closeDatabases()
+	}
+}
+
+func (host *Host) closeDatabases() {
+	host.databasesLock.Lock()
+	defer host.databasesLock.Unlock()
+
+	host.closed = true
+	for key, db := range host.databases {
+		db.Close()
+		delete(host.databases, key)
+	}
+}
+
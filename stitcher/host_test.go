@@ -0,0 +1,40 @@
+package stitcher
+
+import (
+	"testing"
+)
+
+func TestHostClosedAfterRequests(t *testing.T) {
+	host := &Host{Hostname: "close.test"}
+
+	if !host.acquire() {
+		t.Fatal("open host refused a request")
+	}
+
+	db, err := host.Database("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replaced while the request is in flight
+	host.Close()
+
+	if host.acquire() {
+		t.Error("closed host accepted a request")
+	}
+	if err := db.Ping(); err != nil {
+		t.Errorf("database closed under the in flight request: %v", err)
+	}
+	if again, err := host.Database("sqlite", ":memory:"); err != nil || again != db {
+		t.Errorf("in flight request lost its database: %v", err)
+	}
+
+	host.release()
+
+	if err := db.Ping(); err == nil {
+		t.Error("database still open after the last request")
+	}
+	if _, err := host.Database("sqlite", ":memory:"); err == nil {
+		t.Error("closed host reopened a database")
+	}
+}
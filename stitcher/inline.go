@@ -0,0 +1,184 @@
+package stitcher
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/valyala/fasttemplate"
+)
+
+const defaultInlineMaxDepth = 3
+
+// Attributes used to declare an inline include, eg
+// <div data-stitch-src="/api/cart" data-stitch-cache="cart:{{session}}" data-stitch-ttl="30s">
+const (
+	inlineSrcAttribute   = "data-stitch-src"
+	inlineCacheAttribute = "data-stitch-cache"
+	inlineTTLAttribute   = "data-stitch-ttl"
+)
+
+// InlineOptions configures the discovery of includes declared in a
+// fragment's content with data-stitch-* attributes.  The (interpolated)
+// data-stitch-src is fetched and replaces the element's contents, which
+// are left as is (ie as fallback content) if the fetch fails.
+type InlineOptions struct {
+	Enabled bool
+
+	BaseURL string // Relative srcs are resolved against this, eg "http://backend:8080"
+
+	// Only srcs on one of these (with the same scheme and host, and under the
+	// path if there is one) are fetched, eg "http://backend:8080/fragments/"
+	AllowedSources []string
+
+	MaxDepth int // How deeply included content is itself processed, defaults to 3
+}
+
+// ProcessInlineIncludes fetches and inserts the includes declared in doc
+func (fragment *Fragment) ProcessInlineIncludes(site *Host, doc *goquery.Document, contextdata map[string]interface{}) {
+	maxDepth := fragment.Inline.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = defaultInlineMaxDepth
+	}
+
+	depth, _ := contextdata["_inlineDepth"].(int)
+
+	doc.Find("[" + inlineSrcAttribute + "]").Each(func(_ int, element *goquery.Selection) {
+		src := element.AttrOr(inlineSrcAttribute, "")
+		cacheKey := element.AttrOr(inlineCacheAttribute, "")
+		ttl := element.AttrOr(inlineTTLAttribute, "")
+
+		element.RemoveAttr(inlineSrcAttribute)
+		element.RemoveAttr(inlineCacheAttribute)
+		element.RemoveAttr(inlineTTLAttribute)
+
+		if depth >= maxDepth {
+			slog.Warn("Inline include: maximum include depth exceeded", "request_id", contextdata["_requestId"], "src", src, "depth", maxDepth)
+			return
+		}
+
+		content, err := fragment.inlineInclude(site, src, cacheKey, ttl, depth, contextdata)
+
+		if err != nil {
+			slog.Error("Inline include", "request_id", contextdata["_requestId"], "src", src, "error", err)
+			return
+		}
+
+		element.SetHtml(content)
+	})
+}
+
+// inlineInclude fetches (or gets from the cache) src and returns its body's markup
+func (fragment *Fragment) inlineInclude(site *Host, src string, cacheKey string, ttl string, depth int,
+	contextdata map[string]interface{}) (string, error) {
+
+	t, err := fasttemplate.NewTemplate(src, "{{", "}}")
+	if err != nil {
+		return "", err
+	}
+	src = t.ExecuteString(contextdata)
+
+	location, err := url.Parse(src)
+	if err != nil {
+		return "", err
+	}
+
+	if !location.IsAbs() {
+		if fragment.Inline.BaseURL == "" {
+			return "", fmt.Errorf("relative src and no BaseURL")
+		}
+
+		base, err := url.Parse(fragment.Inline.BaseURL)
+		if err != nil {
+			return "", err
+		}
+		location = base.ResolveReference(location)
+	}
+
+	if !sourceAllowed(location, fragment.Inline.AllowedSources) {
+		return "", fmt.Errorf("'%s' is not an allowed source", location)
+	}
+
+	if _, err := fasttemplate.NewTemplate(cacheKey, "{{", "}}"); err != nil {
+		return "", err
+	}
+
+	include := Fragment{
+		Fetcher:  FragmentFetcher{Type: "uri", Source: location.String()},
+		Inline:   fragment.Inline,
+		CacheKey: cacheKey,
+		CacheTTL: ttl,
+	}
+
+	includeContext := copyContext(contextdata)
+	includeContext["_inlineDepth"] = depth + 1
+
+	var content string
+
+	if include.Cachable() {
+		content, err = include.FromCache(site, includeContext)
+	} else {
+		content, err = include.Render(site, includeContext)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(content))
+	if err != nil {
+		return "", err
+	}
+
+	return doc.Find("body").Html()
+}
+
+// sourceAllowed returns true if location is on one of the allowed sources:
+// the same scheme and host and, if the allowed source has one, under its path
+func sourceAllowed(location *url.URL, allowedSources []string) bool {
+	if location.User != nil || location.Opaque != "" {
+		return false
+	}
+
+	// No dot segments, servers would resolve them outside the allowed path
+	locationPath := location.Path
+	if locationPath == "" {
+		locationPath = "/"
+	}
+	if cleaned := path.Clean(locationPath); cleaned != strings.TrimSuffix(locationPath, "/") && cleaned != locationPath {
+		return false
+	}
+
+	for _, source := range allowedSources {
+		allowed, err := url.Parse(source)
+		if err != nil || allowed.User != nil {
+			continue
+		}
+
+		if !strings.EqualFold(location.Scheme, allowed.Scheme) || !strings.EqualFold(location.Host, allowed.Host) {
+			continue
+		}
+
+		prefix := strings.TrimSuffix(path.Clean("/"+allowed.Path), "/")
+		if prefix == "" || locationPath == prefix || strings.HasPrefix(locationPath, prefix+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// copyContext returns a shallow copy of contextdata, for values that only
+// apply to part of a render
+func copyContext(contextdata map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(contextdata)+1)
+
+	for k, v := range contextdata {
+		copied[k] = v
+	}
+
+	return copied
+}
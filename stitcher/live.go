@@ -0,0 +1,474 @@
+package stitcher
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/valyala/fasttemplate"
+)
+
+// End points for live fragment updates, registered on hosts with live fragments
+const (
+	LivePath       = "/_stitcherd/live"
+	LiveScriptPath = "/_stitcherd/live.js"
+)
+
+const (
+	minLiveInterval       = time.Second
+	liveKeepAlive         = 30 * time.Second
+	liveUpstreamRetry     = 5 * time.Second
+	defaultMaxLiveStreams = 1000
+	liveStreamBuffer      = 16
+)
+
+// Connects to the live end point for the current page and swaps in updates
+const liveScript = `(function(){
+var names=document.currentScript.getAttribute("data-fragments")||"";
+var source=new EventSource("` + LivePath + `?path="+encodeURIComponent(location.pathname+location.search)+"&fragments="+encodeURIComponent(names));
+source.addEventListener("fragment",function(e){
+var update=JSON.parse(e.data);
+document.querySelectorAll(update.selector).forEach(function(el){el.outerHTML=update.html});
+});
+})();
+`
+
+// LiveOptions makes a (named) fragment "live": open pages are sent its
+// updated content, re-rendered (through the cache) every Interval and/or
+// whenever EventSource sends an event.
+//
+// Pages opt in by including the client script, optionally limited to some of
+// their live fragments:
+//
+//	<script src="/_stitcherd/live.js" data-fragments="stock,comments"></script>
+//
+// Updates are sent for each of the fragment's replace DocumentTransforms and
+// replace the elements matching its ParentSelector, so the fragment's content
+// should keep matching it (eg by including the same id).
+//
+// Pages open with the same context (eg the same query and session values)
+// share one watcher, and so one upstream connection and re-render, per
+// fragment.
+type LiveOptions struct {
+	Interval    string // Eg "30s", minimum 1s
+	EventSource string // An upstream (interpolated) Server-Sent Events URL
+}
+
+// liveUpdate is the data of a "fragment" event
+type liveUpdate struct {
+	Name     string `json:"name"`
+	Selector string `json:"selector"`
+	HTML     string `json:"html"`
+}
+
+// liveWatcher watches a fragment for the streams subscribed to it, sending
+// each of them the changes
+type liveWatcher struct {
+	streams map[chan liveUpdate]bool // With the host's liveLock
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// IsLive returns true if the fragment pushes updates
+func (fragment *Fragment) IsLive() bool {
+	return fragment.Live.Interval != "" || fragment.Live.EventSource != ""
+}
+
+// LiveFragments returns the fragment and any of its descendants that are live
+func (fragment *Fragment) LiveFragments() []*Fragment {
+	var live []*Fragment
+
+	if fragment.IsLive() {
+		live = append(live, fragment)
+	}
+
+	for i := range fragment.Fragments {
+		live = append(live, fragment.Fragments[i].LiveFragments()...)
+	}
+
+	return live
+}
+
+// HasLiveFragments returns true if any of the host's pages have live fragments
+func (host *Host) HasLiveFragments() bool {
+	for _, route := range host.Routes {
+		if route.Page != nil && len(route.Page.Fragment.LiveFragments()) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// LiveScriptHandler serves the client script
+func LiveScriptHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/javascript")
+	fmt.Fprint(w, liveScript)
+}
+
+// LiveHandler streams updates of the live fragments on the page at ?path=
+// (optionally only those named in ?fragments=) as Server-Sent Events.
+func (host *Host) LiveHandler(w http.ResponseWriter, r *http.Request) {
+	pagePath, err := url.Parse(r.URL.Query().Get("path"))
+	if err != nil || pagePath.Host != "" || !strings.HasPrefix(pagePath.Path, "/") {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	// The page's context is built as if it were being requested
+	page := r.Clone(r.Context())
+	page.Method = http.MethodGet
+	page.URL = &url.URL{Path: pagePath.Path, RawQuery: pagePath.RawQuery}
+	page.RequestURI = pagePath.RequestURI()
+
+	route, page := host.PageRoute(page)
+	if route == nil || route.Page == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	page, ok := route.Authorize(host, w, page)
+	if !ok {
+		return
+	}
+
+	if route.Throttling(r) {
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	var names map[string]bool
+	if list := r.URL.Query().Get("fragments"); list != "" {
+		names = make(map[string]bool)
+		for _, name := range strings.Split(list, ",") {
+			names[strings.TrimSpace(name)] = true
+		}
+	}
+
+	var fragments []*Fragment
+	for _, fragment := range route.Page.Fragment.LiveFragments() {
+		if names == nil || names[fragment.Name] {
+			fragments = append(fragments, fragment)
+		}
+	}
+
+	if len(fragments) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !host.openLiveStream() {
+		slog.Warn("Too many live streams", "host", host.Hostname)
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	defer host.closeLiveStream()
+
+	fetchContext := route.FetchContext(host, page)
+	if host.HasFormActions() {
+		w = withCSRFToken(host, w, r, fetchContext)
+	}
+
+	// Updates go on for as long as the page is open
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	flush()
+
+	ctx := r.Context()
+
+	updates := make(chan liveUpdate, liveStreamBuffer)
+
+	// The last stream to leave a watcher waits for it to be done, so the
+	// watchers are done with the host before the requests are (it may be
+	// closed once it's been replaced)
+	for _, fragment := range fragments {
+		key := liveWatcherKey(fragment, fetchContext)
+		host.subscribeLive(key, fragment, fetchContext, updates)
+		defer host.unsubscribeLive(key, updates)
+	}
+
+	keepAlive := time.NewTicker(liveKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case update := <-updates:
+			data, _ := json.Marshal(update)
+			fmt.Fprintf(w, "event: fragment\ndata: %s\n\n", data)
+			flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flush()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// openLiveStream counts a new stream, returning false if the host has its
+// MaxLiveStreams open already
+func (host *Host) openLiveStream() bool {
+	maxStreams := host.MaxLiveStreams
+	if maxStreams <= 0 {
+		maxStreams = defaultMaxLiveStreams
+	}
+
+	host.liveLock.Lock()
+	defer host.liveLock.Unlock()
+
+	if host.liveStreams >= maxStreams {
+		return false
+	}
+	host.liveStreams++
+	return true
+}
+
+func (host *Host) closeLiveStream() {
+	host.liveLock.Lock()
+	defer host.liveLock.Unlock()
+
+	host.liveStreams--
+}
+
+// liveWatcherKey returns the key of the watcher shared by pages showing
+// fragment with contextdata: what the fragment renders with, less what's
+// particular to each request (its id, span and address)
+func liveWatcherKey(fragment *Fragment, contextdata map[string]interface{}) string {
+	shared := make(map[string]interface{}, len(contextdata))
+	for key, value := range contextdata {
+		switch key {
+		case "_trace", "_requestId", "requestId", "_session":
+			continue
+		case "_request":
+			if request, ok := value.(map[string]interface{}); ok {
+				value = copyContext(request)
+				delete(value.(map[string]interface{}), "remoteAddr")
+			}
+		}
+		shared[key] = value
+	}
+
+	// A context that can't be compared isn't shared
+	b, err := json.Marshal(shared)
+	if err != nil {
+		return fmt.Sprintf("%p:%p", fragment, contextdata)
+	}
+
+	return fmt.Sprintf("%p:%s", fragment, b)
+}
+
+// subscribeLive sends the fragment's changes to stream, starting a watcher
+// for key (with its own copy of contextdata) if there isn't one
+func (host *Host) subscribeLive(key string, fragment *Fragment, contextdata map[string]interface{}, stream chan liveUpdate) {
+	host.liveLock.Lock()
+	defer host.liveLock.Unlock()
+
+	if watcher, ok := host.liveWatchers[key]; ok {
+		watcher.streams[stream] = true
+		return
+	}
+
+	if host.liveWatchers == nil {
+		host.liveWatchers = make(map[string]*liveWatcher)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	watcher := &liveWatcher{streams: map[chan liveUpdate]bool{stream: true}, cancel: cancel, done: make(chan struct{})}
+	host.liveWatchers[key] = watcher
+
+	// It outlives the request that started it, so renders in its own context
+	watchContext := copyContext(contextdata)
+	watchContext["_trace"] = ctx
+
+	go func() {
+		defer close(watcher.done)
+		fragment.watch(ctx, host, watchContext, func(update liveUpdate) {
+			host.publishLive(watcher, update)
+		})
+	}()
+}
+
+// unsubscribeLive stops sending the watcher's changes to stream, stopping the
+// watcher (and waiting for it) if it was the last
+func (host *Host) unsubscribeLive(key string, stream chan liveUpdate) {
+	host.liveLock.Lock()
+	watcher := host.liveWatchers[key]
+	delete(watcher.streams, stream)
+	last := len(watcher.streams) == 0
+	if last {
+		delete(host.liveWatchers, key)
+	}
+	host.liveLock.Unlock()
+
+	if last {
+		watcher.cancel()
+		<-watcher.done
+	}
+}
+
+// publishLive sends update to the watcher's streams.  A stream too far
+// behind misses it rather than holding up the others.
+func (host *Host) publishLive(watcher *liveWatcher, update liveUpdate) {
+	host.liveLock.Lock()
+	defer host.liveLock.Unlock()
+
+	for stream := range watcher.streams {
+		select {
+		case stream <- update:
+		default:
+			slog.Warn("Live stream behind, update dropped", "host", host.Hostname, "fragment", update.Name)
+		}
+	}
+}
+
+// watch re-renders the fragment when it's due (or the upstream says so) and
+// publishes any changes until ctx is done.
+func (fragment *Fragment) watch(ctx context.Context, site *Host, contextdata map[string]interface{}, publish func(liveUpdate)) {
+	refresh := make(chan struct{}, 1)
+
+	if fragment.Live.Interval != "" {
+		interval, err := time.ParseDuration(fragment.Live.Interval)
+		if err != nil {
+			slog.Error("Live fragment: invalid interval", "fragment", fragment.Name, "error", err)
+			return
+		}
+		if interval < minLiveInterval {
+			interval = minLiveInterval
+		}
+
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ticker.C:
+					select {
+					case refresh <- struct{}{}:
+					default:
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	if fragment.Live.EventSource != "" {
+		source := fasttemplate.New(fragment.Live.EventSource, "{{", "}}").ExecuteString(contextdata)
+		go liveUpstream(ctx, source, refresh)
+	}
+
+	// The page was rendered with the current content, only changes are sent
+	last := fragment.liveUpdates(site, contextdata)
+
+	for {
+		select {
+		case <-refresh:
+			for selector, update := range fragment.liveUpdates(site, contextdata) {
+				if last[selector].HTML == update.HTML {
+					continue
+				}
+				last[selector] = update
+
+				publish(update)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// liveUpdates renders the fragment, returning an update for each of its
+// replace transforms keyed by selector
+func (fragment *Fragment) liveUpdates(site *Host, contextdata map[string]interface{}) map[string]liveUpdate {
+	updates := make(map[string]liveUpdate)
+
+	content, err := fragment.Content(site, contextdata)
+	if err != nil {
+		logFragmentError(contextdata, fragment, err)
+		return updates
+	}
+
+	child_doc, err := goquery.NewDocumentFromReader(strings.NewReader(content))
+	if err != nil {
+		return updates
+	}
+
+	for _, transformation := range fragment.DocumentTransforms {
+		if transformation.Type != "replace" || transformation.ParentSelector == "" {
+			continue
+		}
+
+		html, err := transformation.PartialHtml(child_doc)
+		if err != nil {
+			continue
+		}
+
+		updates[transformation.ParentSelector] = liveUpdate{
+			Name:     fragment.Name,
+			Selector: transformation.ParentSelector,
+			HTML:     html,
+		}
+	}
+
+	return updates
+}
+
+// liveUpstream signals refresh for each event from the Server-Sent Events
+// stream at source, reconnecting if it drops, until ctx is done.
+func liveUpstream(ctx context.Context, source string, refresh chan<- struct{}) {
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+		if err != nil {
+			slog.Warn("Live event source", "source", source, "error", err)
+			return
+		}
+		req.Header.Set("Accept", "text/event-stream")
+
+		res, err := http.DefaultClient.Do(req)
+		if err == nil {
+			scanner := bufio.NewScanner(res.Body)
+			pending := false
+
+			for scanner.Scan() {
+				line := scanner.Text()
+
+				if line == "" && pending {
+					pending = false
+					select {
+					case refresh <- struct{}{}:
+					default:
+					}
+				} else if strings.HasPrefix(line, "data:") || strings.HasPrefix(line, "event:") {
+					pending = true
+				}
+			}
+			res.Body.Close()
+		} else {
+			slog.Warn("Live event source", "source", source, "error", err)
+		}
+
+		select {
+		case <-time.After(liveUpstreamRetry):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package stitcher
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLiveStreamsEndOnShutdown(t *testing.T) {
+	stitcherd := (&Stitcherd{}).Init()
+
+	host := &Host{
+		Hostname: "live.test",
+		Routes: []Route{{
+			Path:        "/",
+			RespondWith: "fragmented_page",
+			Page: &FragmentedPage{Fragment: Fragment{
+				Name:    "clock",
+				Fetcher: FragmentFetcher{Source: "<p>tick</p>"},
+				Live:    LiveOptions{Interval: "1m"},
+			}},
+		}},
+	}
+	host.Init()
+	stitcherd.SetHost(host)
+
+	server := httptest.NewUnstartedServer(stitcherd)
+	server.Config.RegisterOnShutdown(stitcherd.stopStreams)
+	server.Start()
+	defer server.Close()
+
+	request, err := http.NewRequest(http.MethodGet, server.URL+LivePath+"?path=/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Host = "live.test"
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d, content type %q", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	if err := server.Config.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown held up by the open stream: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("shutdown took %s", elapsed)
+	}
+}
+
+// openLiveStream opens the live stream for the page at path
+func openLiveStream(t *testing.T, server *httptest.Server, path string) *http.Response {
+	request, err := http.NewRequest(http.MethodGet, server.URL+LivePath+"?path="+url.QueryEscape(path), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Host = "live.test"
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestLiveStreamsCapped(t *testing.T) {
+	stitcherd := (&Stitcherd{}).Init()
+
+	host := &Host{
+		Hostname:       "live.test",
+		MaxLiveStreams: 1,
+		Routes: []Route{{
+			Path:        "/",
+			RespondWith: "fragmented_page",
+			Page: &FragmentedPage{Fragment: Fragment{
+				Name:    "clock",
+				Fetcher: FragmentFetcher{Source: "<p>tick</p>"},
+				Live:    LiveOptions{Interval: "1m"},
+			}},
+		}},
+	}
+	host.Init()
+	stitcherd.SetHost(host)
+
+	server := httptest.NewServer(stitcherd)
+	defer server.Close()
+
+	first := openLiveStream(t, server, "/")
+	if first.StatusCode != http.StatusOK {
+		t.Fatalf("first stream: status %d", first.StatusCode)
+	}
+
+	second := openLiveStream(t, server, "/")
+	second.Body.Close()
+	if second.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("stream over the limit: status %d, want %d", second.StatusCode, http.StatusServiceUnavailable)
+	}
+
+	// Once the first has gone there's room again
+	first.Body.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		third := openLiveStream(t, server, "/")
+		third.Body.Close()
+		if third.StatusCode == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("closed stream still counted: status %d", third.StatusCode)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestLiveWatchersShared(t *testing.T) {
+	// The upstream event source, counting connections by ?id=
+	var upstreamLock sync.Mutex
+	upstreams := make(map[string]int)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamLock.Lock()
+		upstreams[r.URL.Query().Get("id")]++
+		upstreamLock.Unlock()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+
+	// The fragment's content changes each time it's fetched
+	var renders atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<div id="stock">%d</div>`, renders.Add(1))
+	}))
+	defer backend.Close()
+
+	stitcherd := (&Stitcherd{}).Init()
+
+	host := &Host{
+		Hostname: "live.test",
+		Routes: []Route{{
+			Path:        "/",
+			RespondWith: "fragmented_page",
+			Page: &FragmentedPage{Fragment: Fragment{
+				Fetcher: FragmentFetcher{Source: `<div id="stock"></div>`},
+				Fragments: []Fragment{{
+					Name:               "stock",
+					Fetcher:            FragmentFetcher{Type: "uri", Source: backend.URL + "/"},
+					DocumentTransforms: []DocumentTransform{{Type: "replace", ParentSelector: "#stock"}},
+					Live:               LiveOptions{Interval: "1s", EventSource: upstream.URL + "/?id={{id}}"},
+				}},
+			}},
+		}},
+	}
+	host.Init()
+	stitcherd.SetHost(host)
+
+	server := httptest.NewServer(stitcherd)
+	defer server.Close()
+
+	var streams []*http.Response
+	for _, path := range []string{"/?id=1", "/?id=1", "/?id=2"} {
+		stream := openLiveStream(t, server, path)
+		if stream.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status %d", path, stream.StatusCode)
+		}
+		streams = append(streams, stream)
+	}
+
+	// Both pages with id 1 get the same update, from the one render
+	updates := make(chan string, 2)
+	for _, stream := range streams[:2] {
+		go func(stream *http.Response) {
+			scanner := bufio.NewScanner(stream.Body)
+			for scanner.Scan() {
+				if strings.HasPrefix(scanner.Text(), "data: ") {
+					updates <- scanner.Text()
+					return
+				}
+			}
+		}(stream)
+	}
+
+	var received []string
+	for len(received) < 2 {
+		select {
+		case update := <-updates:
+			received = append(received, update)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("updates received: %v", received)
+		}
+	}
+	if received[0] != received[1] {
+		t.Errorf("pages sent different updates: %v", received)
+	}
+
+	upstreamLock.Lock()
+	if upstreams["1"] != 1 || upstreams["2"] != 1 {
+		t.Errorf("upstream connections %v, want one for each id", upstreams)
+	}
+	upstreamLock.Unlock()
+
+	for _, stream := range streams {
+		stream.Body.Close()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		host.liveLock.Lock()
+		watchers, open := len(host.liveWatchers), host.liveStreams
+		host.liveLock.Unlock()
+
+		if watchers == 0 && open == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d watchers and %d streams left", watchers, open)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,132 @@
+package stitcher
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/handlers"
+	"github.com/x-way/crawlerdetect"
+)
+
+// Log formats for LoggingOptions.Format
+const (
+	LogFormatLogfmt = "logfmt"
+	LogFormatJSON   = "json"
+)
+
+// LoggingOptions configures stitcherd's logs, written to stderr
+type LoggingOptions struct {
+	Level  string // debug, info (the default), warn or error
+	Format string // logfmt (the default) or json
+
+	// Also append the access log to this file, in Combined Log Format
+	AccessLog string
+}
+
+// InitLogging sets up the (default) structured logger, which the standard
+// log package also writes to
+func InitLogging(options LoggingOptions) error {
+	var level slog.Level
+	if options.Level != "" {
+		if err := level.UnmarshalText([]byte(options.Level)); err != nil {
+			return fmt.Errorf("unknown log level '%s'", options.Level)
+		}
+	}
+
+	handlerOptions := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch strings.ToLower(options.Format) {
+	case "", LogFormatLogfmt:
+		handler = slog.NewTextHandler(os.Stderr, handlerOptions)
+	case LogFormatJSON:
+		handler = slog.NewJSONHandler(os.Stderr, handlerOptions)
+	default:
+		return fmt.Errorf("unknown log format '%s'", options.Format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+
+	return nil
+}
+
+// combinedLog wraps handler to append its access log, in Combined Log Format, to file
+func combinedLog(file string, handler http.Handler) (http.Handler, error) {
+	if file == "" {
+		return handler, nil
+	}
+
+	var w io.Writer
+	w, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return handlers.CombinedLoggingHandler(w, handler), nil
+}
+
+// requestStats collects what happened during a request for its access log
+type requestStats struct {
+	cacheGets   atomic.Int32
+	cacheMisses atomic.Int32
+}
+
+func withRequestStats(r *http.Request) (*http.Request, *requestStats) {
+	stats := &requestStats{}
+	return r.WithContext(context.WithValue(r.Context(), requestContextKey("stats"), stats)), stats
+}
+
+func requestStatsFrom(ctx context.Context) *requestStats {
+	stats, _ := ctx.Value(requestContextKey("stats")).(*requestStats)
+	return stats
+}
+
+// logAccess logs a request to host that started at start
+func logAccess(host *Host, r *http.Request, w *statusWriter, stats *requestStats, start time.Time) {
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	gets, misses := stats.cacheGets.Load(), stats.cacheMisses.Load()
+
+	slog.Info("request",
+		"request_id", requestTraceID(r),
+		"host", host.Hostname,
+		"route", requestRoute(host, r),
+		"method", r.Method,
+		"path", r.URL.Path,
+		"status", status,
+		"bytes", w.bytes,
+		"duration", time.Since(start),
+		"cache_hits", gets-misses,
+		"cache_misses", misses,
+		"bot", crawlerdetect.IsCrawler(r.UserAgent()),
+		"remote_addr", r.RemoteAddr,
+	)
+}
+
+// logFragmentError logs a fragment that failed to render
+func logFragmentError(contextdata map[string]interface{}, fragment *Fragment, err error) {
+	slog.Error("fragment error",
+		"request_id", contextdata["_requestId"],
+		"fragment", fragmentName(fragment),
+		"type", fetcherType(fragment),
+		"source", fragment.Fetcher.Source,
+		"error", err,
+	)
+}
+
+func fetcherType(fragment *Fragment) string {
+	if fragment.Fetcher.Type == "" {
+		return "string"
+	}
+	return fragment.Fetcher.Type
+}
@@ -0,0 +1,128 @@
+package stitcher
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+	"github.com/yuin/goldmark"
+	highlighting "github.com/yuin/goldmark-highlighting/v2"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/renderer/html"
+	"gopkg.in/yaml.v2"
+)
+
+// NewMarkdown returns a Markdown converter that adds anchor ids to headings.
+// Raw HTML (and javascript: etc links) are only passed through if unsafe is
+// set, for trusted sources.  Fenced code blocks are highlighted with the named
+// chroma style if highlightStyle is not empty.
+func NewMarkdown(highlightStyle string, unsafe bool) goldmark.Markdown {
+	var extensions []goldmark.Extender
+
+	if highlightStyle != "" {
+		extensions = append(extensions, highlighting.NewHighlighting(
+			highlighting.WithStyle(highlightStyle)))
+	}
+
+	var rendererOptions []renderer.Option
+	if unsafe {
+		rendererOptions = append(rendererOptions, html.WithUnsafe())
+	}
+
+	return goldmark.New(
+		goldmark.WithExtensions(extensions...),
+		goldmark.WithParserOptions(parser.WithAutoHeadingID()),
+		goldmark.WithRendererOptions(rendererOptions...),
+	)
+}
+
+// RenderMarkdown converts source to HTML, returning it along with any front matter
+func RenderMarkdown(source string, highlightStyle string, unsafe bool) (string, map[string]interface{}, error) {
+	var buffer bytes.Buffer
+
+	frontMatter, body, err := SplitFrontMatter(source)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := NewMarkdown(highlightStyle, unsafe).Convert([]byte(body), &buffer); err != nil {
+		return "", nil, err
+	}
+
+	return buffer.String(), frontMatter, nil
+}
+
+// SplitFrontMatter separates YAML (---) or TOML (+++) front matter from the
+// rest of a document.  Documents without front matter are returned unchanged
+// with a nil map.
+func SplitFrontMatter(source string) (map[string]interface{}, string, error) {
+	var delimiter string
+
+	switch {
+	case strings.HasPrefix(source, "---\n"), strings.HasPrefix(source, "---\r\n"):
+		delimiter = "---"
+	case strings.HasPrefix(source, "+++\n"), strings.HasPrefix(source, "+++\r\n"):
+		delimiter = "+++"
+	default:
+		return nil, source, nil
+	}
+
+	lines := strings.SplitAfter(source, "\n")
+
+	for i := 1; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) != delimiter {
+			continue
+		}
+
+		header := strings.Join(lines[1:i], "")
+		body := strings.Join(lines[i+1:], "")
+
+		frontMatter := make(map[string]interface{})
+
+		if delimiter == "+++" {
+			tree, err := toml.Load(header)
+			if err != nil {
+				return nil, "", err
+			}
+			frontMatter = tree.ToMap()
+		} else {
+			if err := yaml.Unmarshal([]byte(header), &frontMatter); err != nil {
+				return nil, "", err
+			}
+			frontMatter = stringKeys(frontMatter).(map[string]interface{})
+		}
+
+		return frontMatter, body, nil
+	}
+
+	// No closing delimiter, treat it all as Markdown
+	return nil, source, nil
+}
+
+// stringKeys converts the map[interface{}]interface{} maps YAML decodes
+// nested values to (which JSON and templates can't use) into
+// map[string]interface{}
+func stringKeys(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(value))
+		for key, v := range value {
+			converted[fmt.Sprint(key)] = stringKeys(v)
+		}
+		return converted
+	case map[string]interface{}:
+		for key, v := range value {
+			value[key] = stringKeys(v)
+		}
+		return value
+	case []interface{}:
+		for i, v := range value {
+			value[i] = stringKeys(v)
+		}
+		return value
+	default:
+		return value
+	}
+}
@@ -0,0 +1,93 @@
+package stitcher
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		unsafe bool
+		want   []string
+		not    []string
+	}{
+		{"heading ids", "# Hello World\n\nSome *text*.\n", false,
+			[]string{`<h1 id="hello-world">Hello World</h1>`, "<em>text</em>"}, nil},
+		{"raw html dropped", "<script>alert(1)</script>\n\n[x](javascript:alert(1))\n", false,
+			[]string{"<!-- raw HTML omitted -->"}, []string{"<script>", "javascript:"}},
+		{"raw html when unsafe", "<div class=\"note\">hi</div>\n", true,
+			[]string{`<div class="note">hi</div>`}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			content, frontMatter, err := RenderMarkdown(test.source, "", test.unsafe)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if frontMatter != nil {
+				t.Errorf("front matter %v", frontMatter)
+			}
+			for _, want := range test.want {
+				if !strings.Contains(content, want) {
+					t.Errorf("%q doesn't have %q", content, want)
+				}
+			}
+			for _, not := range test.not {
+				if strings.Contains(content, not) {
+					t.Errorf("%q has %q", content, not)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitFrontMatter(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   map[string]interface{}
+		body   string
+	}{
+		{"yaml", "---\ntitle: Hello\ntags: [a, b]\nauthor:\n  name: Jane\n  links:\n    - site: example.com\n---\n# Body\n",
+			map[string]interface{}{
+				"title":  "Hello",
+				"tags":   []interface{}{"a", "b"},
+				"author": map[string]interface{}{"name": "Jane", "links": []interface{}{map[string]interface{}{"site": "example.com"}}},
+			}, "# Body\n"},
+		{"toml", "+++\ntitle = \"Hello\"\n[author]\nname = \"Jane\"\n+++\n# Body\n",
+			map[string]interface{}{"title": "Hello", "author": map[string]interface{}{"name": "Jane"}}, "# Body\n"},
+		{"crlf", "---\r\ntitle: Hello\r\n---\r\nBody\r\n",
+			map[string]interface{}{"title": "Hello"}, "Body\r\n"},
+		{"none", "# Just Markdown\n", nil, "# Just Markdown\n"},
+		{"unclosed", "---\ntitle: Hello\n", nil, "---\ntitle: Hello\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frontMatter, body, err := SplitFrontMatter(test.source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(frontMatter, test.want) {
+				t.Errorf("front matter %#v, want %#v", frontMatter, test.want)
+			}
+			if body != test.body {
+				t.Errorf("body %q, want %q", body, test.body)
+			}
+
+			// Front matter is a RouteDataFragment's (JSON) data
+			if _, err := json.Marshal(frontMatter); err != nil {
+				t.Errorf("front matter doesn't marshal: %v", err)
+			}
+		})
+	}
+
+	if _, _, err := SplitFrontMatter("---\ntitle: [unclosed\n---\n"); err == nil {
+		t.Error("invalid front matter accepted")
+	}
+}
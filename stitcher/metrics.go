@@ -0,0 +1,182 @@
+package stitcher
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mailgun/groupcache/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsPath is where the Prometheus metrics are served
+const MetricsPath = "/metrics"
+
+// Metrics holds stitcherd's Prometheus metrics
+var Metrics = prometheus.NewRegistry()
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "stitcherd_requests_total",
+		Help: "Requests by host, route and status.",
+	}, []string{"host", "route", "status"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "stitcherd_request_duration_seconds",
+		Help:    "Request latency by host, route and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"host", "route", "status"})
+
+	fetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "stitcherd_fragment_fetch_duration_seconds",
+		Help:    "Fragment fetch latency by fetcher type and fragment name.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"type", "fragment"})
+
+	fetchErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "stitcherd_fragment_fetch_errors_total",
+		Help: "Failed fragment fetches by fetcher type and fragment name.",
+	}, []string{"type", "fragment"})
+
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "stitcherd_rate_limited_total",
+		Help: "Requests rejected by the rate limiters by route and client (bot or human).",
+	}, []string{"route", "client"})
+
+	templateErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "stitcherd_template_errors_total",
+		Help: "Template render errors by template.",
+	}, []string{"template"})
+)
+
+func init() {
+	Metrics.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requestsTotal, requestDuration, fetchDuration, fetchErrors, rateLimited, templateErrors,
+	)
+}
+
+// MetricsHandler serves the metrics in the Prometheus exposition format
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(Metrics, promhttp.HandlerOpts{})
+}
+
+// observeFetch records a fragment fetch that started at start
+func observeFetch(fragment *Fragment, start time.Time, err error) {
+	fetcherType, name := fetcherType(fragment), fragmentName(fragment)
+
+	fetchDuration.WithLabelValues(fetcherType, name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		fetchErrors.WithLabelValues(fetcherType, name).Inc()
+	}
+}
+
+// observeRequest records a request to host that started at start
+func observeRequest(host *Host, r *http.Request, status int, start time.Time) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	labels := []string{host.Hostname, requestRoute(host, r), strconv.Itoa(status)}
+	requestsTotal.WithLabelValues(labels...).Inc()
+	requestDuration.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+}
+
+// requestRoute returns the path (template) of the host's route matching r, or "none"
+func requestRoute(host *Host, r *http.Request) string {
+	var match mux.RouteMatch
+	if host.Router.Match(r, &match) && match.Route != nil {
+		if template, err := match.Route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return "none"
+}
+
+// statusWriter records the status and size of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// Flush keeps streamed pages and live updates working
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// cacheCollector exports the groupcache stats of the hosts
+type cacheCollector struct {
+	hosts func() []*Host
+}
+
+var (
+	cacheGetsDesc       = prometheus.NewDesc("stitcherd_cache_gets_total", "Cache gets.", []string{"host"}, nil)
+	cacheHitsDesc       = prometheus.NewDesc("stitcherd_cache_hits_total", "Cache hits.", []string{"host"}, nil)
+	cacheLoadsDesc      = prometheus.NewDesc("stitcherd_cache_loads_total", "Cache loads (gets less hits).", []string{"host"}, nil)
+	cachePeerErrorsDesc = prometheus.NewDesc("stitcherd_cache_peer_errors_total", "Cache peer errors.", []string{"host"}, nil)
+	cacheEvictionsDesc  = prometheus.NewDesc("stitcherd_cache_evictions_total", "Cache evictions.", []string{"host", "cache"}, nil)
+	cacheBytesDesc      = prometheus.NewDesc("stitcherd_cache_bytes", "Cache size in bytes.", []string{"host", "cache"}, nil)
+)
+
+func (collector *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{cacheGetsDesc, cacheHitsDesc, cacheLoadsDesc,
+		cachePeerErrorsDesc, cacheEvictionsDesc, cacheBytesDesc} {
+		ch <- desc
+	}
+}
+
+func (collector *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, host := range collector.hosts() {
+		if host.Cache == nil {
+			continue
+		}
+
+		stats := &host.Cache.Stats
+		ch <- prometheus.MustNewConstMetric(cacheGetsDesc, prometheus.CounterValue, float64(stats.Gets.Get()), host.Hostname)
+		ch <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, float64(stats.CacheHits.Get()), host.Hostname)
+		ch <- prometheus.MustNewConstMetric(cacheLoadsDesc, prometheus.CounterValue, float64(stats.Loads.Get()), host.Hostname)
+		ch <- prometheus.MustNewConstMetric(cachePeerErrorsDesc, prometheus.CounterValue, float64(stats.PeerErrors.Get()), host.Hostname)
+
+		for cache, which := range map[string]groupcache.CacheType{"main": groupcache.MainCache, "hot": groupcache.HotCache} {
+			cacheStats := host.Cache.CacheStats(which)
+			ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(cacheStats.Evictions), host.Hostname, cache)
+			ch <- prometheus.MustNewConstMetric(cacheBytesDesc, prometheus.GaugeValue, float64(cacheStats.Bytes), host.Hostname, cache)
+		}
+	}
+}
+
+// registerCacheCollector exports the cache stats of hosts
+func registerCacheCollector(hosts func() []*Host) {
+	if err := Metrics.Register(&cacheCollector{hosts: hosts}); err != nil {
+		slog.Error("Error registering cache metrics", "error", err)
+	}
+}
@@ -0,0 +1,45 @@
+package stitcher
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCacheCollectorConcurrentWithSetHost(t *testing.T) {
+	stitcherd := (&Stitcherd{}).Init()
+	collector := &cacheCollector{hosts: stitcherd.Hosts}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			host := &Host{Hostname: fmt.Sprintf("metrics%d.test", i)}
+			host.Init()
+			stitcherd.SetHost(host)
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			ch := make(chan prometheus.Metric)
+			go func() {
+				collector.Collect(ch)
+				close(ch)
+			}()
+			for range ch {
+			}
+		}
+	}()
+
+	wg.Wait()
+
+	if hosts := len(stitcherd.Hosts()); hosts != 50 {
+		t.Errorf("%d hosts, want 50", hosts)
+	}
+}
@@ -0,0 +1,311 @@
+package stitcher
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// OIDCCallbackPath is where the provider sends users back to after logging in
+const OIDCCallbackPath = "/_stitcherd/oidc/callback"
+
+// Session keys of a login in progress and of the logged in user's details
+const (
+	sessionIdPKey      = "_idp"
+	sessionGroupsKey   = "_groups"
+	sessionClaimsKey   = "_claims"
+	sessionStateKey    = "_oidc_state"
+	sessionVerifierKey = "_oidc_verifier"
+	sessionNonceKey    = "_oidc_nonce"
+	sessionNextKey     = "_oidc_next"
+)
+
+const oidcTimeout = 10 * time.Second
+
+// OIDCOptions configures logging in with an OpenID Connect provider, using the
+// authorization code flow with PKCE, for routes requiring the "oidc" Scheme
+type OIDCOptions struct {
+	Issuer       string // Eg "https://accounts.example.com", discovered on first use
+	ClientID     string
+	ClientSecret Secret
+
+	// Eg "https://example.com/_stitcherd/oidc/callback", defaults to
+	// OIDCCallbackPath on the requested host
+	RedirectURL string
+
+	Scopes        []string // Defaults to openid, profile and email
+	UsernameClaim string   // Defaults to preferred_username, falling back to sub
+	GroupsClaim   string   // Defaults to groups
+
+	// The ID token claims kept in the session (for claims.<name>, forwarded
+	// headers and JWTs), defaults to sub, name, email and preferred_username.
+	// The username claim and those named in Forward.Headers are always kept.
+	Claims []string
+
+	provider     *oidc.Provider
+	providerLock sync.Mutex
+}
+
+// getProvider discovers the provider's configuration, retrying on later logins if it fails
+func (options *OIDCOptions) getProvider(ctx context.Context) (*oidc.Provider, error) {
+	options.providerLock.Lock()
+	defer options.providerLock.Unlock()
+
+	if options.provider != nil {
+		return options.provider, nil
+	}
+
+	provider, err := oidc.NewProvider(oidc.ClientContext(ctx, http.DefaultClient), options.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	options.provider = provider
+
+	return provider, nil
+}
+
+// config returns the OAuth2 client configuration for a request to host
+func (options *OIDCOptions) config(provider *oidc.Provider, r *http.Request) (*oauth2.Config, error) {
+	secret, err := options.ClientSecret.Bytes()
+	if err != nil && options.ClientSecret.IsSet() {
+		return nil, err
+	}
+
+	redirectURL := options.RedirectURL
+	if redirectURL == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		redirectURL = scheme + "://" + r.Host + OIDCCallbackPath
+	}
+
+	scopes := options.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{oidc.ScopeOpenID, "profile", "email"}
+	}
+
+	return &oauth2.Config{
+		ClientID:     options.ClientID,
+		ClientSecret: string(secret),
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  redirectURL,
+		Scopes:       scopes,
+	}, nil
+}
+
+// oidcLogin sends the user to the provider to log in, returning to the requested page afterwards
+func (host *Host) oidcLogin(w http.ResponseWriter, r *http.Request) {
+	options := host.Auth.OIDC
+
+	ctx, cancel := context.WithTimeout(r.Context(), oidcTimeout)
+	defer cancel()
+
+	provider, err := options.getProvider(ctx)
+	if err != nil {
+		slog.Error("OIDC discovery", "issuer", options.Issuer, "error", err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	config, err := options.config(provider, r)
+	if err != nil {
+		slog.Error("OIDC client secret", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	state, nonce, verifier := randomToken(), randomToken(), oauth2.GenerateVerifier()
+
+	session := host.LoadSession(r)
+	session.Set(sessionStateKey, state)
+	session.Set(sessionNonceKey, nonce)
+	session.Set(sessionVerifierKey, verifier)
+	session.Set(sessionNextKey, r.URL.RequestURI())
+	if err := host.SaveSession(w, r, map[string]interface{}{"_session": session}); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), http.StatusFound)
+}
+
+// OIDCCallbackHandler completes a login: exchanging the code for tokens,
+// verifying the ID token and keeping the user's claims in their session
+func (host *Host) OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	options := host.Auth.OIDC
+	session := host.LoadSession(r)
+
+	state := session.Get(sessionStateKey)
+	if state == "" || r.URL.Query().Get("state") != state {
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+
+	if message := r.URL.Query().Get("error"); message != "" {
+		slog.Warn("OIDC login failed", "error", message, "description", r.URL.Query().Get("error_description"))
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), oidcTimeout)
+	defer cancel()
+
+	claims, err := options.exchange(ctx, r, session)
+	if err != nil {
+		slog.Warn("OIDC login failed", "error", err)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	user := options.claimsUser(claims)
+	if user.Name == "" {
+		slog.Warn("OIDC login failed: no username claim")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	encoded, err := json.Marshal(options.sessionClaims(host.Auth, claims))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	next := session.Get(sessionNextKey)
+	for _, key := range []string{sessionStateKey, sessionNonceKey, sessionVerifierKey, sessionNextKey} {
+		session.Delete(key)
+	}
+
+	session.Renew()
+	session.Set(sessionUserKey, user.Name)
+	session.Set(sessionIdPKey, "oidc")
+	session.Set(sessionGroupsKey, strings.Join(user.Groups, ","))
+	session.Set(sessionClaimsKey, string(encoded))
+	if err := host.SaveSession(w, r, map[string]interface{}{"_session": session}); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("User logged in", "user", user.Name, "issuer", options.Issuer)
+	http.Redirect(w, r, localRedirect(next), http.StatusSeeOther)
+}
+
+// exchange swaps the callback's code for tokens and returns the verified ID token's claims
+func (options *OIDCOptions) exchange(ctx context.Context, r *http.Request, session *Session) (map[string]interface{}, error) {
+	provider, err := options.getProvider(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := options.config(provider, r)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := config.Exchange(ctx, r.URL.Query().Get("code"), oauth2.VerifierOption(session.Get(sessionVerifierKey)))
+	if err != nil {
+		return nil, fmt.Errorf("exchanging code: %v", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("no id_token in token response")
+	}
+
+	// Checks the signature (against the provider's JWKS), issuer, audience and expiry
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: options.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if idToken.Nonce != session.Get(sessionNonceKey) {
+		return nil, fmt.Errorf("nonce mismatch")
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// claimsUser returns the user described by an ID token's claims
+func (options *OIDCOptions) claimsUser(claims map[string]interface{}) *AuthUser {
+	user := &AuthUser{Claims: claims}
+
+	usernameClaim := options.UsernameClaim
+	if usernameClaim == "" {
+		usernameClaim = "preferred_username"
+	}
+	user.Name, _ = claims[usernameClaim].(string)
+	if user.Name == "" && options.UsernameClaim == "" {
+		user.Name, _ = claims["sub"].(string)
+	}
+
+	groupsClaim := options.GroupsClaim
+	if groupsClaim == "" {
+		groupsClaim = "groups"
+	}
+	switch groups := claims[groupsClaim].(type) {
+	case []interface{}:
+		for _, group := range groups {
+			user.Groups = append(user.Groups, fmt.Sprint(group))
+		}
+	case string:
+		user.Groups = strings.Fields(strings.ReplaceAll(groups, ",", " "))
+	}
+
+	return user
+}
+
+// sessionClaims returns the claims worth keeping in the session, which may
+// well be a cookie with little room
+func (options *OIDCOptions) sessionClaims(auth *AuthOptions, claims map[string]interface{}) map[string]interface{} {
+	names := options.Claims
+	if len(names) == 0 {
+		names = []string{"sub", "name", "email", "preferred_username"}
+	}
+	names = append(names, options.UsernameClaim)
+	for _, claim := range auth.Forward.Headers {
+		names = append(names, claim)
+	}
+
+	kept := make(map[string]interface{})
+	for _, name := range names {
+		if value, ok := claims[name]; ok {
+			kept[name] = value
+		}
+	}
+
+	return kept
+}
+
+// claimsSessionUser returns the user logged in with OIDC or SAML from their session
+func claimsSessionUser(session *Session) *AuthUser {
+	user := &AuthUser{Name: session.Get(sessionUserKey)}
+
+	if groups := session.Get(sessionGroupsKey); groups != "" {
+		user.Groups = strings.Split(groups, ",")
+	}
+
+	json.Unmarshal([]byte(session.Get(sessionClaimsKey)), &user.Claims)
+
+	return user
+}
+
+func randomToken() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,283 @@
+package stitcher
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// mockIssuer is a local OpenID Connect provider.  It hands out a code for
+// each authorization request the test follows, and checks its PKCE verifier.
+type mockIssuer struct {
+	*httptest.Server
+
+	key    *rsa.PrivateKey
+	claims map[string]interface{} // Extra claims for ID tokens
+
+	lock  sync.Mutex
+	codes map[string]mockAuthorization
+}
+
+type mockAuthorization struct {
+	challenge string
+	nonce     string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuer := &mockIssuer{key: key, codes: make(map[string]mockAuthorization)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                issuer.URL,
+			"authorization_endpoint":                issuer.URL + "/authorize",
+			"token_endpoint":                        issuer.URL + "/token",
+			"jwks_uri":                              issuer.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/token", issuer.token)
+
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+
+	return issuer
+}
+
+// authorize plays the provider's login page, returning the code to call back with
+func (issuer *mockIssuer) authorize(t *testing.T, location string) (code string, query url.Values) {
+	authURL, err := url.Parse(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(location, issuer.URL+"/authorize?") {
+		t.Fatalf("not sent to the provider: %s", location)
+	}
+
+	query = authURL.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		t.Fatalf("no PKCE challenge: %s", location)
+	}
+	if query.Get("state") == "" || query.Get("nonce") == "" {
+		t.Fatalf("no state or nonce: %s", location)
+	}
+
+	code = randomToken()
+
+	issuer.lock.Lock()
+	issuer.codes[code] = mockAuthorization{challenge: query.Get("code_challenge"), nonce: query.Get("nonce")}
+	issuer.lock.Unlock()
+
+	return code, query
+}
+
+func (issuer *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	issuer.lock.Lock()
+	authorization, ok := issuer.codes[r.PostForm.Get("code")]
+	delete(issuer.codes, r.PostForm.Get("code"))
+	issuer.lock.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != authorization.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: issuer.key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "test"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":   issuer.URL,
+		"sub":   "user-1",
+		"aud":   "stitcherd",
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Minute).Unix(),
+		"nonce": authorization.nonce,
+	}
+	for name, value := range issuer.claims {
+		claims[name] = value
+	}
+
+	idToken, err := jwt.Signed(signer).Claims(claims).Serialize()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   60,
+		"id_token":     idToken,
+	})
+}
+
+func newOIDCHost(t *testing.T, issuer *mockIssuer, claims []string) *Stitcherd {
+	stitcherd := (&Stitcherd{}).Init()
+
+	host := &Host{
+		Hostname: "oidc.test",
+		Auth: &AuthOptions{
+			OIDC:    &OIDCOptions{Issuer: issuer.URL, ClientID: "stitcherd", Claims: claims},
+			Protect: map[string]AuthRequirement{"/account/": {Scheme: "oidc"}},
+		},
+		Routes: []Route{{
+			Path:        "/account/",
+			RespondWith: "fragmented_page",
+			Page:        &FragmentedPage{Fragment: Fragment{Name: "account", Fetcher: FragmentFetcher{Source: "<p>account</p>"}}},
+		}},
+	}
+	host.Init()
+	stitcherd.SetHost(host)
+
+	return stitcherd
+}
+
+// oidcLogin follows a visit to a protected page through to the callback,
+// letting tamper change the authorization the provider sees first
+func oidcLogin(t *testing.T, stitcherd *Stitcherd, issuer *mockIssuer, tamper func(code string, query url.Values)) *httptest.ResponseRecorder {
+	visit := httptest.NewRecorder()
+	stitcherd.ServeHTTP(visit, httptest.NewRequest(http.MethodGet, "http://oidc.test/account/", nil))
+	if visit.Code != http.StatusFound {
+		t.Fatalf("protected page: status %d, want a redirect to the provider", visit.Code)
+	}
+
+	code, query := issuer.authorize(t, visit.Header().Get("Location"))
+	if tamper != nil {
+		tamper(code, query)
+	}
+
+	callback := httptest.NewRequest(http.MethodGet, "http://oidc.test"+OIDCCallbackPath+"?"+
+		url.Values{"code": {code}, "state": {query.Get("state")}}.Encode(), nil)
+	for _, cookie := range visit.Result().Cookies() {
+		callback.AddCookie(cookie)
+	}
+
+	recorder := httptest.NewRecorder()
+	stitcherd.ServeHTTP(recorder, callback)
+	return recorder
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := newMockIssuer(t)
+	issuer.claims = map[string]interface{}{
+		"preferred_username": "jane",
+		"email":              "jane@example.com",
+		"picture":            strings.Repeat("x", 4096),
+	}
+
+	stitcherd := newOIDCHost(t, issuer, nil)
+
+	callback := oidcLogin(t, stitcherd, issuer, nil)
+	if callback.Code != http.StatusSeeOther || callback.Header().Get("Location") != "/account/" {
+		t.Fatalf("callback: status %d, location %q", callback.Code, callback.Header().Get("Location"))
+	}
+
+	page := httptest.NewRequest(http.MethodGet, "http://oidc.test/account/", nil)
+	for _, cookie := range callback.Result().Cookies() {
+		page.AddCookie(cookie)
+	}
+
+	recorder := httptest.NewRecorder()
+	stitcherd.ServeHTTP(recorder, page)
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "account") {
+		t.Fatalf("logged in page: status %d, body %q", recorder.Code, recorder.Body.String())
+	}
+
+	user := claimsSessionUser(stitcherd.hosts.Get("oidc.test").LoadSession(page))
+	if user.Name != "jane" || user.Claims["email"] != "jane@example.com" || user.Claims["sub"] != "user-1" {
+		t.Errorf("session user %+v", user)
+	}
+	for _, claim := range []string{"picture", "nonce", "iss", "aud"} {
+		if _, ok := user.Claims[claim]; ok {
+			t.Errorf("claim %q kept in the session", claim)
+		}
+	}
+}
+
+func TestOIDCLoginRejected(t *testing.T) {
+	issuer := newMockIssuer(t)
+	issuer.claims = map[string]interface{}{"preferred_username": "jane"}
+
+	tests := []struct {
+		name   string
+		tamper func(code string, query url.Values)
+		status int
+	}{
+		{"state", func(code string, query url.Values) {
+			query.Set("state", "forged")
+		}, http.StatusBadRequest},
+		{"nonce", func(code string, query url.Values) {
+			issuer.lock.Lock()
+			authorization := issuer.codes[code]
+			authorization.nonce = "replayed"
+			issuer.codes[code] = authorization
+			issuer.lock.Unlock()
+		}, http.StatusUnauthorized},
+		{"pkce", func(code string, query url.Values) {
+			issuer.lock.Lock()
+			authorization := issuer.codes[code]
+			authorization.challenge = "intercepted"
+			issuer.codes[code] = authorization
+			issuer.lock.Unlock()
+		}, http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			callback := oidcLogin(t, newOIDCHost(t, issuer, nil), issuer, test.tamper)
+			if callback.Code != test.status {
+				t.Errorf("status %d, want %d", callback.Code, test.status)
+			}
+			if len(callback.Result().Cookies()) > 0 {
+				t.Errorf("session saved for a rejected login")
+			}
+		})
+	}
+}
+
+func TestOIDCLoginSessionTooLarge(t *testing.T) {
+	issuer := newMockIssuer(t)
+	issuer.claims = map[string]interface{}{
+		"preferred_username": "jane",
+		"picture":            strings.Repeat("x", 4096),
+	}
+
+	// The claim doesn't fit in a cookie session
+	callback := oidcLogin(t, newOIDCHost(t, issuer, []string{"picture"}), issuer, nil)
+	if callback.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want %d", callback.Code, http.StatusInternalServerError)
+	}
+}
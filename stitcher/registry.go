@@ -0,0 +1,166 @@
+package stitcher
+
+import (
+	"log/slog"
+	"net"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// Hostnames made of these are also matched exactly
+var literalHostname = regexp.MustCompile(`^[A-Za-z0-9.:-]+$`)
+
+// hostRegistry holds the hosts being served.  Changes rebuild the index under
+// the lock so requests see the hosts either before or after a change.
+//
+// Requests go to the first host, highest Priority first, whose Hostname or one
+// of its Aliases is the requested host (with or without its port), or else
+// whose Hostname (as a regular expression, literal ones included) matches it.
+// Within a Priority exact names come first, then the longest patterns, then
+// the longest literal Hostnames.  A request no host matches goes to the
+// Default host.
+type hostRegistry struct {
+	lock sync.RWMutex
+
+	hosts    map[string]*Host // By Hostname
+	exact    map[string]*Host // Literal Hostnames and Aliases
+	ordered  []*Host          // In match order
+	fallback *Host
+}
+
+func newHostRegistry() *hostRegistry {
+	return &hostRegistry{
+		hosts: make(map[string]*Host),
+		exact: make(map[string]*Host),
+	}
+}
+
+// Match returns the host serving hostname, or nil if there isn't one
+func (registry *hostRegistry) Match(hostname string) *Host {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	exact, ok := registry.exact[hostname]
+	if !ok {
+		if name, _, err := net.SplitHostPort(hostname); err == nil {
+			exact = registry.exact[name]
+		}
+	}
+
+	for _, host := range registry.ordered {
+		// An exact name beats the patterns of its own, and lower, priorities
+		if exact != nil && exact.Priority >= host.Priority {
+			return exact
+		}
+		if host.Match(hostname) {
+			return host
+		}
+	}
+
+	if exact != nil {
+		return exact
+	}
+
+	return registry.fallback
+}
+
+// Get returns the host with Hostname, if there is one
+func (registry *hostRegistry) Get(hostname string) *Host {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	return registry.hosts[hostname]
+}
+
+// All returns the hosts in match order
+func (registry *hostRegistry) All() []*Host {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	return append([]*Host(nil), registry.ordered...)
+}
+
+// update adds (or replaces) hosts and removes those with the hostnames in
+// one go, returning the hosts no longer served
+func (registry *hostRegistry) update(hosts []*Host, remove []string) []*Host {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	var replaced []*Host
+
+	for _, hostname := range remove {
+		if old, ok := registry.hosts[hostname]; ok {
+			replaced = append(replaced, old)
+			delete(registry.hosts, hostname)
+		}
+	}
+
+	for _, host := range hosts {
+		if old, ok := registry.hosts[host.Hostname]; ok && old != host {
+			replaced = append(replaced, old)
+		}
+		registry.hosts[host.Hostname] = host
+	}
+
+	registry.index()
+
+	return replaced
+}
+
+// index orders the hosts and rebuilds the exact and default lookups, with
+// the lock held
+func (registry *hostRegistry) index() {
+	ordered := make([]*Host, 0, len(registry.hosts))
+	for _, host := range registry.hosts {
+		ordered = append(ordered, host)
+	}
+
+	// Highest Priority first, then patterns before literal hostnames (which
+	// match as patterns too, but less deliberately), then the longest
+	sort.Slice(ordered, func(i, j int) bool {
+		a, b := ordered[i], ordered[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		if literalA, literalB := literalHostname.MatchString(a.Hostname), literalHostname.MatchString(b.Hostname); literalA != literalB {
+			return literalB
+		}
+		if len(a.Hostname) != len(b.Hostname) {
+			return len(a.Hostname) > len(b.Hostname)
+		}
+		return a.Hostname < b.Hostname
+	})
+
+	exact := make(map[string]*Host)
+	var fallback *Host
+
+	for _, host := range ordered {
+		names := host.Aliases
+		if literalHostname.MatchString(host.Hostname) {
+			names = append([]string{host.Hostname}, names...)
+		}
+
+		for _, name := range names {
+			if other, ok := exact[name]; ok {
+				if other != host {
+					slog.Warn("Host name served by another host", "name", name, "host", host.Hostname, "served_by", other.Hostname)
+				}
+				continue
+			}
+			exact[name] = host
+		}
+
+		if host.Default {
+			if fallback != nil {
+				slog.Warn("More than one default host", "host", host.Hostname, "default", fallback.Hostname)
+				continue
+			}
+			fallback = host
+		}
+	}
+
+	registry.ordered = ordered
+	registry.exact = exact
+	registry.fallback = fallback
+}
@@ -0,0 +1,98 @@
+package stitcher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHostRegistryMatch(t *testing.T) {
+	newHost := func(hostname string, priority int, aliases ...string) *Host {
+		host := &Host{Hostname: hostname, Priority: priority, Aliases: aliases}
+		host.Init()
+		return host
+	}
+
+	example := newHost("example.com", 0, "localhost")
+	api := newHost(`^api\..*`, 0)
+	shop := newHost("shop.example.com", 0)
+	preferred := newHost(`^preferred\.`, 10)
+	fallback := newHost("fallback.test", 0)
+	fallback.Default = true
+
+	registry := newHostRegistry()
+	registry.update([]*Host{example, api, shop, preferred, fallback}, nil)
+
+	tests := []struct {
+		hostname string
+		want     *Host
+	}{
+		{"example.com", example},
+		{"example.com:3000", example},
+		{"localhost:3000", example},
+		{"shop.example.com", shop},
+
+		// Literal Hostnames are (unanchored) patterns too
+		{"www.example.com", example},
+		{"api.example.com", api},
+
+		// A higher Priority pattern beats exact names
+		{"preferred.example.com", preferred},
+
+		{"other.test", fallback},
+	}
+
+	for _, test := range tests {
+		if got := registry.Match(test.hostname); got != test.want {
+			t.Errorf("Match(%q) = %v, want %v", test.hostname, hostnameOf(got), test.want.Hostname)
+		}
+	}
+
+	// An exact name beats the patterns at its own priority, whatever their length
+	long := newHost(`^shop\.example\.com$|^never$`, 0)
+	registry.update([]*Host{long}, nil)
+	if got := registry.Match("shop.example.com"); got != shop {
+		t.Errorf("Match(shop.example.com) = %v, want the exact host", hostnameOf(got))
+	}
+}
+
+func hostnameOf(host *Host) string {
+	if host == nil {
+		return "<nil>"
+	}
+	return host.Hostname
+}
+
+func TestDefaultHostLeavesAdminEndPoints(t *testing.T) {
+	stitcherd := (&Stitcherd{AdminEnabled: true, AdminHostName: "admin.test"}).Init()
+
+	fallback := &Host{Hostname: "default.test", Default: true}
+	fallback.Init()
+	stitcherd.SetHost(fallback)
+
+	for _, test := range []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{http.MethodGet, "/hosts", http.StatusOK},
+		{http.MethodGet, "/status", http.StatusOK},
+		{http.MethodGet, MetricsPath, http.StatusOK},
+		{http.MethodGet, "/hosts/load/missing.json", http.StatusInternalServerError},
+		{http.MethodPost, "/hosts/unload/missing.test", http.StatusNotFound},
+	} {
+		recorder := httptest.NewRecorder()
+		stitcherd.ServeHTTP(recorder, httptest.NewRequest(test.method, "http://admin.test"+test.path, nil))
+
+		// Not the default host's (it has no routes) 404
+		if recorder.Code != test.want || strings.Contains(recorder.Body.String(), "404 page not found") {
+			t.Errorf("%s %s: %d %q, want %d", test.method, test.path, recorder.Code, recorder.Body.String(), test.want)
+		}
+	}
+
+	// Other hosts still fall back to the default
+	if got := stitcherd.hosts.Match("other.test"); got != fallback {
+		t.Errorf("Match(other.test) = %v, want the default host", hostnameOf(got))
+	}
+}
@@ -0,0 +1,42 @@
+package stitcher
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/vhodges/stitcherd/signing"
+)
+
+const defaultSigningKeyID = "default"
+
+// SigningOptions signs requests to backends with a shared secret (see the
+// signing package, which backends can use to verify them).  The secret is
+// only ever read from the environment or a file.
+type SigningOptions struct {
+	KeyID      string // Lets backends pick the secret (eg while rotating it), defaults to "default"
+	SecretEnv  string // Name of the environment variable holding the secret
+	SecretFile string // Path of a file holding the secret
+
+	// Request headers covered by the signature (as well as the method, path,
+	// query, host, timestamp and body)
+	Headers []string
+}
+
+// sign signs req, if signing is configured
+func (options *SigningOptions) sign(req *http.Request) error {
+	if options == nil {
+		return nil
+	}
+
+	secret, err := Secret{Env: options.SecretEnv, File: options.SecretFile}.Bytes()
+	if err != nil {
+		return err
+	}
+
+	keyID := options.KeyID
+	if keyID == "" {
+		keyID = defaultSigningKeyID
+	}
+
+	return signing.Sign(req, keyID, secret, options.Headers, time.Now())
+}
@@ -2,9 +2,9 @@ package stitcher
 
 import (
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
@@ -37,6 +37,22 @@ type Route struct {
 	// ProxyHost string
 	// ProxyString??? string
 
+	// Form submissions, keyed by method (eg "POST").  Routes with Actions
+	// only render their page for GET and HEAD requests.
+	Actions map[string]*FormAction
+
+	// Restricts the route to logged in users (see also Host.Auth.Protect)
+	Auth *AuthRequirement
+
+	// Request headers made available to templates as .request.headers
+	ExposeHeaders []string
+
+	// Stream the page (StreamOutOfOrder or StreamInOrder) rather than sending
+	// it once it's complete.  Fragments not ready after StreamFlushAfter
+	// (default 50ms) are sent as they arrive.
+	Stream           string
+	StreamFlushAfter string
+
 	// Rate limiter
 	MaxRate       float64
 	AllowBurst    int
@@ -54,24 +70,23 @@ func (route *Route) Init(host *Host) {
 		route.normalLimiter = rate.NewLimiter(rate.Limit(route.MaxRate),
 			route.AllowBurst)
 
-		log.Printf("Added rate limiter for '%s' Rate: %f Burst: %d\n",
-			route.Path, rate.Limit(route.MaxRate), route.AllowBurst)
+		slog.Debug("Added rate limiter", "route", route.Path, "rate", route.MaxRate, "burst", route.AllowBurst)
 	}
 
 	if route.BotMaxRate > 0 && route.BotAllowBurst > 0 {
 		route.botLimiter = rate.NewLimiter(rate.Limit(route.BotMaxRate),
 			route.BotAllowBurst)
 
-		log.Printf("Added bot limiter for '%s' Rate: %f Burst: %d\n",
-			route.Path, rate.Limit(route.BotMaxRate), route.BotAllowBurst)
+		slog.Debug("Added bot limiter", "route", route.Path, "rate", route.BotMaxRate, "burst", route.BotAllowBurst)
 	}
 
 	// Add the handler for the route
 	switch route.RespondWith {
 	case "fragmented_page":
-		host.Router.HandleFunc(route.Path, FragmentedPageHandler(host, *route))
+		muxRoute := host.Router.HandleFunc(route.Path, FragmentedPageHandler(host, *route))
+		host.pageRoutes[muxRoute] = route
 	case "static_content":
-		host.Router.PathPrefix(route.Path).Handler(http.StripPrefix(route.Path, http.FileServer(http.Dir(route.StaticPath))))
+		host.Router.PathPrefix(route.Path).Handler(route.protect(host, http.StripPrefix(route.Path, http.FileServer(http.Dir(route.StaticPath)))))
 	case "redirect":
 	case "proxy":
 	}
@@ -82,38 +97,74 @@ func (route *Route) Init(host *Host) {
 func (route *Route) Throttling(r *http.Request) bool {
 
 	var limiter = route.normalLimiter
+	var client = "human"
 
 	if route.botLimiter != nil && crawlerdetect.IsCrawler(r.UserAgent()) {
-		log.Println("Crawler detected")
+		slog.Debug("Crawler detected", "route", route.Path, "user_agent", r.UserAgent())
 		limiter = route.botLimiter
+		client = "bot"
 	}
 
-	if limiter != nil {
-		return !limiter.Allow()
+	if limiter != nil && !limiter.Allow() {
+		rateLimited.WithLabelValues(route.Path, client).Inc()
+		return true
 	}
 
 	return false
 }
 
-func (route *Route) nextRequestID() string {
+// nextRequestID returns the request's trace id, or a timestamp if it isn't traced
+func (route *Route) nextRequestID(r *http.Request) string {
+	if id := requestTraceID(r); id != "" {
+		return id
+	}
 	return fmt.Sprintf("%d", time.Now().UnixNano())
 }
 
-// FragmentedPageHandler Renders the route.Page
-func (route *Route) FragmentedPageHandler(site *Host, w http.ResponseWriter, r *http.Request) {
-	var err error
+// requestData returns the request metadata made available to templates as .request
+func (route *Route) requestData(r *http.Request) map[string]interface{} {
+	query := make(map[string]interface{})
+	for key, element := range r.URL.Query() {
+		if len(element) == 0 {
+			query[key] = ""
+		} else {
+			query[key] = element[0]
+		}
+	}
 
-	start := time.Now()
+	headers := make(map[string]interface{})
+	for _, name := range route.ExposeHeaders {
+		if value := r.Header.Get(name); value != "" {
+			headers[http.CanonicalHeaderKey(name)] = value
+		}
+	}
 
-	var fetchContext map[string]interface{} = make(map[string]interface{})
+	vars := make(map[string]interface{})
+	for key, element := range mux.Vars(r) {
+		vars[key] = element
+	}
 
-	if route.Throttling(r) {
-		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
-		return
+	return map[string]interface{}{
+		"vars":       vars,
+		"method":     r.Method,
+		"host":       r.Host,
+		"remoteAddr": r.RemoteAddr,
+		"path":       r.URL.Path,
+		"rawQuery":   r.URL.RawQuery,
+		"query":      query,
+		"headers":    headers,
 	}
+}
+
+// FetchContext builds the context used to fetch (and interpolate) the route's fragments
+func (route *Route) FetchContext(site *Host, r *http.Request) map[string]interface{} {
 
-	// TODO Better request tracing... (context.Context too?)
-	fetchContext["_requestId"] = route.nextRequestID()
+	var fetchContext map[string]interface{} = make(map[string]interface{})
+
+	// The request's span, the parent of the fragments' spans
+	fetchContext["_trace"] = r.Context()
+	fetchContext["_requestId"] = route.nextRequestID(r)
+	fetchContext["requestId"] = fetchContext["_requestId"]
 
 	// Any params passed in, make available to the request.
 	for key, element := range mux.Vars(r) {
@@ -132,7 +183,14 @@ func (route *Route) FragmentedPageHandler(site *Host, w http.ResponseWriter, r *
 
 	fetchContext["host"] = r.Host
 
+	fetchContext["_request"] = route.requestData(r)
+
 	for key, element := range r.URL.Query() {
+		// Keys starting with _ are stitcherd's own (eg _request)
+		if strings.HasPrefix(key, "_") {
+			continue
+		}
+
 		if len(element) == 0 {
 			fetchContext[key] = ""
 		} else {
@@ -140,11 +198,40 @@ func (route *Route) FragmentedPageHandler(site *Host, w http.ResponseWriter, r *
 		}
 	}
 
-	if route.RouteDataFragment != nil {
-		log.Printf("RouteDataFragment was not nil\n")
+	if site.sessionStore != nil {
+		session := site.LoadSession(r)
+		fetchContext["_session"] = session
+		setSessionContext(fetchContext, session)
+	}
+
+	// Only stitcherd sets these, whatever the query says
+	deletePrefixed(fetchContext, "auth.")
+	deletePrefixed(fetchContext, "form.")
+	deletePrefixed(fetchContext, "claims.")
 
+	if user := RequestUser(r); user != nil {
+		fetchContext["auth.user"] = user.Name
+		fetchContext["auth.groups"] = strings.Join(user.Groups, ",")
+
+		for claim := range user.Claims {
+			fetchContext["claims."+claim] = user.Claim(claim)
+		}
+
+		fetchContext["_forwardHeaders"] = site.Auth.forwardHeaders(user)
+	}
+
+	// Submitted form values are form.<name>
+	for key, element := range r.PostForm {
+		if len(element) == 0 {
+			fetchContext["form."+key] = ""
+		} else {
+			fetchContext["form."+key] = element[0]
+		}
+	}
+
+	if route.RouteDataFragment != nil {
 		// Fetch a data blob Fragement to use to augment fetchContext
-		routeData := route.RouteDataFragment.GetData(fetchContext)
+		routeData := route.RouteDataFragment.GetData(site, fetchContext)
 
 		// Add the key,value pairs to fetchContext
 		for k,v := range routeData {
@@ -155,22 +242,78 @@ func (route *Route) FragmentedPageHandler(site *Host, w http.ResponseWriter, r *
 
 	// TODO Add Headers? Cookies? to fetchContext
 
+	return fetchContext
+}
+
+// FragmentedPageHandler Renders the route.Page
+func (route *Route) FragmentedPageHandler(site *Host, w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	if route.Throttling(r) {
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	fetchContext := route.FetchContext(site, r)
+
+	if site.HasFormActions() {
+		w = withCSRFToken(site, w, r, fetchContext)
+	}
+
+	if mode := site.debugMode(r); mode != "" {
+		route.DebugRender(site, mode, fetchContext, w, r)
+		return
+	}
+
+	if route.Stream != "" {
+		flushAfter, _ := time.ParseDuration(route.StreamFlushAfter)
+
+		// Fragments streamed after this can't change (cookie) sessions
+		site.SaveSession(w, r, fetchContext)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+		if err = route.Page.Stream(site, w, fetchContext, route.Stream, flushAfter); err != nil {
+			slog.Error("Error streaming page", "request_id", fetchContext["_requestId"], "route", route.Path, "error", err)
+		}
+		return
+	}
+
 	content := route.Page.Render(site, fetchContext)
 
+	site.SaveSession(w, r, fetchContext)
+
 	if err != nil {
-		log.Printf("Error from endpoint '%s': %v", route.Path, err)
+		slog.Error("Error from endpoint", "request_id", fetchContext["_requestId"], "route", route.Path, "error", err)
 		fmt.Fprintln(w, "")
 	} else {
 		fmt.Fprintln(w, content)
 	}
-
-	elapsed := time.Since(start)
-	log.Println(fetchContext["_requestId"], r.Host, r.Method, r.URL.Path, r.Proto, elapsed)
 }
 
 // FragmentedPageHandler uses the Source to render content
 func FragmentedPageHandler(site *Host, route Route) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		r, ok := route.Authorize(site, w, r)
+		if !ok {
+			return
+		}
+
+		if site.Auth != nil && route.Path == site.Auth.LoginPath && r.Method == http.MethodPost {
+			route.LoginHandler(site, w, r)
+			return
+		}
+
+		if action, ok := route.Actions[r.Method]; ok {
+			route.FormHandler(site, action, w, r)
+			return
+		}
+
+		if len(route.Actions) > 0 && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", route.allowedMethods())
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
 		route.FragmentedPageHandler(site, w, r)
 	}
 }
@@ -0,0 +1,61 @@
+package stitcher
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFetchContextIgnoresOwnKeysInQuery(t *testing.T) {
+	site := &Host{Hostname: "context.test"}
+	route := &Route{Path: "/"}
+
+	r := httptest.NewRequest("GET", "http://context.test/?_request=x&_requestId=forged&_trace=x&sku=42", nil)
+	fetchContext := route.FetchContext(site, r)
+
+	if _, ok := fetchContext["_request"].(map[string]interface{}); !ok {
+		t.Errorf("_request is %#v", fetchContext["_request"])
+	}
+	if fetchContext["_requestId"] == "forged" {
+		t.Error("request id taken from the query")
+	}
+	if fetchContext["_trace"] == "x" {
+		t.Error("trace context taken from the query")
+	}
+	if fetchContext["sku"] != "42" {
+		t.Errorf("sku = %v, want 42", fetchContext["sku"])
+	}
+}
+
+func TestFetchContextIgnoresAuthAndFormInQuery(t *testing.T) {
+	site := &Host{Hostname: "context.test"}
+	route := &Route{Path: "/"}
+
+	r := httptest.NewRequest("GET", "http://context.test/?auth.user=admin&auth.groups=admin&form.email=x&claims.email=victim@example.com", nil)
+	fetchContext := route.FetchContext(site, r)
+
+	for _, key := range []string{"auth.user", "auth.groups", "form.email", "claims.email"} {
+		if value, ok := fetchContext[key]; ok {
+			t.Errorf("%s = %v, taken from the query", key, value)
+		}
+	}
+}
+
+func TestFetchContextIgnoresClaimsInQuery(t *testing.T) {
+	site := &Host{Hostname: "context.test", Auth: &AuthOptions{}}
+	route := &Route{Path: "/"}
+
+	// The user's session has no email claim
+	user := &AuthUser{Name: "jane", Claims: map[string]interface{}{"name": "Jane"}}
+
+	r := httptest.NewRequest("GET", "http://context.test/?claims.email=victim@example.com", nil)
+	r = r.WithContext(context.WithValue(r.Context(), authUserContextKey{}, user))
+	fetchContext := route.FetchContext(site, r)
+
+	if value, ok := fetchContext["claims.email"]; ok {
+		t.Errorf("claims.email = %v, taken from the query", value)
+	}
+	if fetchContext["claims.name"] != "Jane" || fetchContext["auth.user"] != "jane" {
+		t.Errorf("user's values missing: %v, %v", fetchContext["claims.name"], fetchContext["auth.user"])
+	}
+}
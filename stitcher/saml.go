@@ -0,0 +1,384 @@
+package stitcher
+
+import (
+	"crypto"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// End points of a host's SAML service provider
+const (
+	SAMLMetadataPath = "/_stitcherd/saml/metadata"
+	SAMLACSPath      = "/_stitcherd/saml/acs"
+)
+
+const (
+	samlRequestTTL  = 10 * time.Minute // How long a user has to log in with the IdP
+	samlMaxRequests = 10000            // Logins in progress kept, the oldest are dropped
+
+	// Ties logins in progress to the browser that started them
+	samlBrowserCookie = "stitcherd_saml"
+)
+
+// SAMLOptions makes the host a SAML service provider, for routes requiring the
+// "saml" Scheme.  Our metadata is served at SAMLMetadataPath and the IdP posts
+// its (signed) assertions to SAMLACSPath.
+type SAMLOptions struct {
+	IdPMetadata string // Path of the IdP's metadata XML
+
+	RootURL  string // Where the host is, eg "https://www.example.com"
+	EntityID string // Defaults to the metadata URL
+
+	// Our certificate and (RSA) key, as PEM files
+	Certificate string
+	Key         string
+
+	SignRequests      bool // Sign our authentication requests
+	AllowIDPInitiated bool // Accept logins started at the IdP
+
+	UsernameAttribute string // Defaults to the NameID
+	GroupsAttribute   string
+
+	// Attribute names (or friendly names) and the claims they're mapped to,
+	// eg {"urn:oid:0.9.2342.19200300.100.1.3": "email"}.  If not given,
+	// attributes are mapped by friendly name (or name) but only sub, mail,
+	// email, displayName, cn and uid, and the claims in Forward.Headers, are
+	// kept in the session.
+	Attributes map[string]string
+
+	sp *saml.ServiceProvider
+
+	requests     map[string]samlRequest // By relay state
+	requestOrder []string               // Relay states, oldest first
+	requestsLock sync.Mutex
+}
+
+// samlRequest is a login in progress
+type samlRequest struct {
+	id      string
+	next    string
+	browser string // The samlBrowserCookie of the browser that started it
+	expires time.Time
+}
+
+// addRequest tracks a login in progress, dropping expired ones and, if there
+// are too many, the oldest
+func (options *SAMLOptions) addRequest(relayState string, request samlRequest) {
+	options.requestsLock.Lock()
+	defer options.requestsLock.Unlock()
+
+	if options.requests == nil {
+		options.requests = make(map[string]samlRequest)
+	}
+
+	// Requests expire in the order they're made
+	now := time.Now()
+	for len(options.requestOrder) > 0 {
+		oldest := options.requestOrder[0]
+		pending, ok := options.requests[oldest]
+		if ok && now.Before(pending.expires) && len(options.requestOrder) < samlMaxRequests {
+			break
+		}
+		delete(options.requests, oldest)
+		options.requestOrder = options.requestOrder[1:]
+	}
+
+	options.requests[relayState] = request
+	options.requestOrder = append(options.requestOrder, relayState)
+}
+
+// takeRequest returns (and forgets) the login in progress with relayState
+func (options *SAMLOptions) takeRequest(relayState string) (samlRequest, bool) {
+	options.requestsLock.Lock()
+	defer options.requestsLock.Unlock()
+
+	request, ok := options.requests[relayState]
+	delete(options.requests, relayState)
+
+	return request, ok && time.Now().Before(request.expires)
+}
+
+// initSAML creates the host's service provider and registers its end points
+func (host *Host) initSAML() {
+	options := host.Auth.SAML
+
+	sp, err := options.serviceProvider()
+	if err != nil {
+		slog.Error("SAML service provider", "host", host.Hostname, "error", err)
+		return
+	}
+	options.sp = sp
+
+	host.Router.HandleFunc(SAMLMetadataPath, host.SAMLMetadataHandler)
+	host.Router.HandleFunc(SAMLACSPath, host.SAMLACSHandler).Methods(http.MethodPost)
+}
+
+func (options *SAMLOptions) serviceProvider() (*saml.ServiceProvider, error) {
+	metadata, err := ioutil.ReadFile(options.IdPMetadata)
+	if err != nil {
+		return nil, err
+	}
+
+	idpMetadata, err := samlsp.ParseMetadata(metadata)
+	if err != nil {
+		return nil, fmt.Errorf("IdP metadata: %v", err)
+	}
+
+	pair, err := tls.LoadX509KeyPair(options.Certificate, options.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type")
+	}
+
+	root, err := url.Parse(options.RootURL)
+	if err != nil || root.Host == "" {
+		return nil, fmt.Errorf("invalid RootURL '%s'", options.RootURL)
+	}
+
+	sp := &saml.ServiceProvider{
+		EntityID:          options.EntityID,
+		Key:               key,
+		Certificate:       certificate,
+		MetadataURL:       *root.ResolveReference(&url.URL{Path: SAMLMetadataPath}),
+		AcsURL:            *root.ResolveReference(&url.URL{Path: SAMLACSPath}),
+		IDPMetadata:       idpMetadata,
+		AllowIDPInitiated: options.AllowIDPInitiated,
+	}
+
+	if options.SignRequests {
+		sp.SignatureMethod = dsig.RSASHA256SignatureMethod
+	}
+
+	return sp, nil
+}
+
+// SAMLMetadataHandler serves our service provider metadata, for the IdP
+func (host *Host) SAMLMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	metadata, err := xml.MarshalIndent(host.Auth.SAML.sp.Metadata(), "", "  ")
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write(metadata)
+}
+
+// samlLogin sends the user to the IdP to log in, returning to the requested page afterwards
+func (host *Host) samlLogin(w http.ResponseWriter, r *http.Request) {
+	options := host.Auth.SAML
+	if options.sp == nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	request, err := options.sp.MakeAuthenticationRequest(options.sp.GetSSOBindingLocation(saml.HTTPRedirectBinding),
+		saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		slog.Error("SAML authentication request", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// The IdP's response is a cross site POST, which won't have our (SameSite)
+	// session cookie, so the request is tracked by its relay state and tied
+	// to the browser by a cookie that is sent cross site
+	browser := randomToken()
+	if cookie, err := r.Cookie(samlBrowserCookie); err == nil && len(cookie.Value) == len(browser) {
+		browser = cookie.Value
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     samlBrowserCookie,
+		Value:    browser,
+		Path:     SAMLACSPath,
+		MaxAge:   int(samlRequestTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteNoneMode,
+	})
+
+	relayState := randomToken()
+	options.addRequest(relayState, samlRequest{id: request.ID, next: r.URL.RequestURI(), browser: browser,
+		expires: time.Now().Add(samlRequestTTL)})
+
+	redirect, err := request.Redirect(relayState, options.sp)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// SAMLACSHandler validates the assertion posted by the IdP and logs the user in
+func (host *Host) SAMLACSHandler(w http.ResponseWriter, r *http.Request) {
+	options := host.Auth.SAML
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxFormSize)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	var requestIDs []string
+	next := "/"
+
+	if request, ok := options.takeRequest(r.PostForm.Get("RelayState")); ok {
+		// Only in the browser that started it (else it's someone else's login)
+		cookie, err := r.Cookie(samlBrowserCookie)
+		if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(request.browser)) != 1 {
+			slog.Warn("SAML login failed: started in another browser")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		requestIDs = append(requestIDs, request.id)
+		next = request.next
+	}
+
+	// Checks the signature (against the IdP's metadata), audience, validity and request id
+	assertion, err := options.sp.ParseResponse(r, requestIDs)
+	if err != nil {
+		if invalid, ok := err.(*saml.InvalidResponseError); ok {
+			err = invalid.PrivateErr
+		}
+		slog.Warn("SAML login failed", "error", err)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	user := options.assertionUser(assertion)
+	if user.Name == "" {
+		slog.Warn("SAML login failed: no username")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	encoded, err := json.Marshal(options.sessionClaims(host.Auth, user.Claims))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	session := host.LoadSession(r)
+	session.Renew()
+	session.Set(sessionUserKey, user.Name)
+	session.Set(sessionIdPKey, "saml")
+	session.Set(sessionGroupsKey, strings.Join(user.Groups, ","))
+	session.Set(sessionClaimsKey, string(encoded))
+	if err := host.SaveSession(w, r, map[string]interface{}{"_session": session}); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("User logged in", "user", user.Name, "issuer", assertion.Issuer.Value)
+	http.Redirect(w, r, localRedirect(next), http.StatusSeeOther)
+}
+
+// assertionUser returns the user described by an assertion, with its (mapped) attributes as claims
+func (options *SAMLOptions) assertionUser(assertion *saml.Assertion) *AuthUser {
+	user := &AuthUser{Claims: make(map[string]interface{})}
+
+	if assertion.Subject != nil && assertion.Subject.NameID != nil {
+		user.Name = assertion.Subject.NameID.Value
+		user.Claims["sub"] = user.Name
+	}
+
+	for _, statement := range assertion.AttributeStatements {
+		for _, attribute := range statement.Attributes {
+			values := make([]string, 0, len(attribute.Values))
+			for _, value := range attribute.Values {
+				values = append(values, value.Value)
+			}
+
+			if options.matches(attribute, options.UsernameAttribute) && len(values) > 0 {
+				user.Name = values[0]
+			}
+			if options.matches(attribute, options.GroupsAttribute) {
+				user.Groups = append(user.Groups, values...)
+			}
+
+			claim := options.claim(attribute)
+			if claim == "" {
+				continue
+			}
+
+			if len(values) == 1 {
+				user.Claims[claim] = values[0]
+			} else {
+				list := make([]interface{}, len(values))
+				for i, value := range values {
+					list[i] = value
+				}
+				user.Claims[claim] = list
+			}
+		}
+	}
+
+	return user
+}
+
+// sessionClaims returns the claims worth keeping in the session, which may
+// well be a cookie with little room
+func (options *SAMLOptions) sessionClaims(auth *AuthOptions, claims map[string]interface{}) map[string]interface{} {
+	if len(options.Attributes) > 0 {
+		return claims
+	}
+
+	names := []string{"sub", "mail", "email", "displayName", "cn", "uid"}
+	for _, claim := range auth.Forward.Headers {
+		names = append(names, claim)
+	}
+
+	kept := make(map[string]interface{})
+	for _, name := range names {
+		if value, ok := claims[name]; ok {
+			kept[name] = value
+		}
+	}
+
+	return kept
+}
+
+func (options *SAMLOptions) matches(attribute saml.Attribute, name string) bool {
+	return name != "" && (attribute.Name == name || attribute.FriendlyName == name)
+}
+
+// claim returns the claim an attribute is mapped to, if any
+func (options *SAMLOptions) claim(attribute saml.Attribute) string {
+	if len(options.Attributes) == 0 {
+		if attribute.FriendlyName != "" {
+			return attribute.FriendlyName
+		}
+		return attribute.Name
+	}
+
+	if claim, ok := options.Attributes[attribute.Name]; ok {
+		return claim
+	}
+	return options.Attributes[attribute.FriendlyName]
+}
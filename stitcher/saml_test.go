@@ -0,0 +1,329 @@
+package stitcher
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+)
+
+// newTestCertificate returns a self signed certificate and its key
+func newTestCertificate(t *testing.T, name string) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certificate, key
+}
+
+// testIdP is a local IdP, making assertions for the service provider
+type testIdP struct {
+	saml.IdentityProvider
+	sp *saml.ServiceProvider
+}
+
+func (idp *testIdP) GetServiceProvider(r *http.Request, serviceProviderID string) (*saml.EntityDescriptor, error) {
+	if serviceProviderID != idp.sp.MetadataURL.String() {
+		return nil, os.ErrNotExist
+	}
+	return idp.sp.Metadata(), nil
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	certificate, key := newTestCertificate(t, "idp.test")
+
+	idp := &testIdP{}
+	idp.IdentityProvider = saml.IdentityProvider{
+		Key:                     key,
+		Certificate:             certificate,
+		MetadataURL:             url.URL{Scheme: "https", Host: "idp.test", Path: "/metadata"},
+		SSOURL:                  url.URL{Scheme: "https", Host: "idp.test", Path: "/sso"},
+		ServiceProviderProvider: idp,
+	}
+
+	return idp
+}
+
+// newSAMLHost returns a host whose service provider trusts idp, with its
+// own certificate and key
+func newSAMLHost(t *testing.T, idp *testIdP) *Stitcherd {
+	dir := t.TempDir()
+
+	metadata, err := xml.Marshal(idp.Metadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, key := newTestCertificate(t, "saml.test")
+
+	files := map[string][]byte{
+		"idp.xml": metadata,
+		"sp.crt":  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}),
+		"sp.key":  pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+	}
+	for name, b := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stitcherd := (&Stitcherd{}).Init()
+
+	host := &Host{
+		Hostname: "saml.test",
+		Auth: &AuthOptions{
+			SAML: &SAMLOptions{
+				IdPMetadata:     filepath.Join(dir, "idp.xml"),
+				RootURL:         "http://saml.test",
+				Certificate:     filepath.Join(dir, "sp.crt"),
+				Key:             filepath.Join(dir, "sp.key"),
+				GroupsAttribute: "eduPersonAffiliation",
+			},
+			Protect: map[string]AuthRequirement{"/account/": {Scheme: "saml"}},
+		},
+		Routes: []Route{{
+			Path:        "/account/",
+			RespondWith: "fragmented_page",
+			Page:        &FragmentedPage{Fragment: Fragment{Name: "account", Fetcher: FragmentFetcher{Source: "<p>account</p>"}}},
+		}},
+	}
+	host.Init()
+	stitcherd.SetHost(host)
+
+	if host.Auth.SAML.sp == nil {
+		t.Fatal("no service provider")
+	}
+	idp.sp = host.Auth.SAML.sp
+
+	return stitcherd
+}
+
+// samlPost is an assertion form, as the IdP would post it back, and the
+// browser's cookies
+type samlPost struct {
+	form    url.Values
+	cookies []*http.Cookie
+}
+
+// samlResponse follows a visit to a protected page to the IdP and returns the
+// assertion form it would post back, letting prepare change the request first
+func samlResponse(t *testing.T, stitcherd *Stitcherd, idp *testIdP, prepare func(*saml.IdpAuthnRequest)) samlPost {
+	visit := httptest.NewRecorder()
+	stitcherd.ServeHTTP(visit, httptest.NewRequest(http.MethodGet, "http://saml.test/account/", nil))
+	if visit.Code != http.StatusFound {
+		t.Fatalf("protected page: status %d, want a redirect to the IdP", visit.Code)
+	}
+
+	location := visit.Header().Get("Location")
+	if !strings.HasPrefix(location, idp.SSOURL.String()+"?") {
+		t.Fatalf("not sent to the IdP: %s", location)
+	}
+
+	request, err := saml.NewIdpAuthnRequest(&idp.IdentityProvider, httptest.NewRequest(http.MethodGet, location, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := request.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if prepare != nil {
+		prepare(request)
+	}
+
+	session := &saml.Session{
+		ID:        "session-1",
+		NameID:    "jane",
+		UserEmail: "jane@example.com",
+		Groups:    []string{"staff"},
+	}
+	if err := (saml.DefaultAssertionMaker{}).MakeAssertion(request, session); err != nil {
+		t.Fatal(err)
+	}
+
+	form, err := request.PostBinding()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return samlPost{
+		form:    url.Values{"SAMLResponse": {form.SAMLResponse}, "RelayState": {form.RelayState}},
+		cookies: visit.Result().Cookies(),
+	}
+}
+
+func postSAMLResponse(stitcherd *Stitcherd, post samlPost) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "http://saml.test"+SAMLACSPath, strings.NewReader(post.form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range post.cookies {
+		request.AddCookie(cookie)
+	}
+
+	recorder := httptest.NewRecorder()
+	stitcherd.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestSAMLLogin(t *testing.T) {
+	idp := newTestIdP(t)
+	stitcherd := newSAMLHost(t, idp)
+
+	acs := postSAMLResponse(stitcherd, samlResponse(t, stitcherd, idp, nil))
+	if acs.Code != http.StatusSeeOther || acs.Header().Get("Location") != "/account/" {
+		t.Fatalf("acs: status %d, location %q", acs.Code, acs.Header().Get("Location"))
+	}
+
+	page := httptest.NewRequest(http.MethodGet, "http://saml.test/account/", nil)
+	for _, cookie := range acs.Result().Cookies() {
+		page.AddCookie(cookie)
+	}
+
+	recorder := httptest.NewRecorder()
+	stitcherd.ServeHTTP(recorder, page)
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "account") {
+		t.Fatalf("logged in page: status %d, body %q", recorder.Code, recorder.Body.String())
+	}
+
+	user := claimsSessionUser(stitcherd.hosts.Get("saml.test").LoadSession(page))
+	if user.Name != "jane" || user.Claims["mail"] != "jane@example.com" || !user.InGroup([]string{"staff"}) {
+		t.Errorf("session user %+v", user)
+	}
+
+	// Only the claims worth keeping (eg not the groups attribute again)
+	for claim := range user.Claims {
+		switch claim {
+		case "sub", "mail", "email", "displayName", "cn", "uid":
+		default:
+			t.Errorf("claim %s kept in the session", claim)
+		}
+	}
+}
+
+func TestSAMLLoginRejected(t *testing.T) {
+	idp := newTestIdP(t)
+
+	tests := []struct {
+		name string
+		post func(t *testing.T, stitcherd *Stitcherd) samlPost
+	}{
+		{"other idp", func(t *testing.T, stitcherd *Stitcherd) samlPost {
+			// Same entity, different key
+			impostor := newTestIdP(t)
+			impostor.sp = idp.sp
+			return samlResponse(t, stitcherd, impostor, nil)
+		}},
+		{"tampered", func(t *testing.T, stitcherd *Stitcherd) samlPost {
+			post := samlResponse(t, stitcherd, idp, func(request *saml.IdpAuthnRequest) {
+				// Unencrypted, so the assertion can be edited
+				request.SPSSODescriptor.KeyDescriptors = nil
+			})
+			response, err := base64.StdEncoding.DecodeString(post.form.Get("SAMLResponse"))
+			if err != nil || !strings.Contains(string(response), ">jane<") {
+				t.Fatalf("unexpected response %q (%v)", response, err)
+			}
+			post.form.Set("SAMLResponse", base64.StdEncoding.EncodeToString([]byte(strings.ReplaceAll(string(response), ">jane<", ">admin<"))))
+			return post
+		}},
+		{"expired", func(t *testing.T, stitcherd *Stitcherd) samlPost {
+			return samlResponse(t, stitcherd, idp, func(request *saml.IdpAuthnRequest) {
+				request.Now = request.Now.Add(-time.Hour)
+			})
+		}},
+		{"unsolicited", func(t *testing.T, stitcherd *Stitcherd) samlPost {
+			post := samlResponse(t, stitcherd, idp, nil)
+			post.form.Set("RelayState", "unknown")
+			return post
+		}},
+		{"replayed", func(t *testing.T, stitcherd *Stitcherd) samlPost {
+			post := samlResponse(t, stitcherd, idp, nil)
+			if acs := postSAMLResponse(stitcherd, post); acs.Code != http.StatusSeeOther {
+				t.Fatalf("first post: status %d", acs.Code)
+			}
+			return post
+		}},
+		{"garbage", func(t *testing.T, stitcherd *Stitcherd) samlPost {
+			return samlPost{form: url.Values{"SAMLResponse": {base64.StdEncoding.EncodeToString([]byte("<Response/>"))}}}
+		}},
+		{"other browser", func(t *testing.T, stitcherd *Stitcherd) samlPost {
+			// Eg an attacker's own login, posted from the victim's browser
+			post := samlResponse(t, stitcherd, idp, nil)
+			post.cookies = nil
+			return post
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stitcherd := newSAMLHost(t, idp)
+
+			acs := postSAMLResponse(stitcherd, test.post(t, stitcherd))
+			if acs.Code != http.StatusUnauthorized {
+				t.Errorf("status %d, want %d", acs.Code, http.StatusUnauthorized)
+			}
+			for _, cookie := range acs.Result().Cookies() {
+				if cookie.Name == defaultSessionCookie {
+					t.Errorf("session saved for a rejected login")
+				}
+			}
+		})
+	}
+}
+
+func TestSAMLRequestsBounded(t *testing.T) {
+	options := &SAMLOptions{}
+
+	for i := 0; i < samlMaxRequests+10; i++ {
+		options.addRequest(fmt.Sprint(i), samlRequest{expires: time.Now().Add(time.Minute)})
+	}
+	if len(options.requests) != samlMaxRequests || len(options.requestOrder) != samlMaxRequests {
+		t.Errorf("%d requests (%d in order) kept, want %d", len(options.requests), len(options.requestOrder), samlMaxRequests)
+	}
+	if _, ok := options.takeRequest("0"); ok {
+		t.Error("oldest request kept")
+	}
+	if _, ok := options.takeRequest(fmt.Sprint(samlMaxRequests + 9)); !ok {
+		t.Error("newest request dropped")
+	}
+
+	// Expired requests go as new ones come in
+	options = &SAMLOptions{}
+	options.addRequest("expired", samlRequest{expires: time.Now().Add(-time.Second)})
+	options.addRequest("current", samlRequest{expires: time.Now().Add(time.Minute)})
+	if _, ok := options.requests["expired"]; ok || len(options.requests) != 1 {
+		t.Errorf("expired request kept: %v", options.requests)
+	}
+}
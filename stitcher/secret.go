@@ -0,0 +1,45 @@
+package stitcher
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Secret is a key given in the configuration, or (better) read from an
+// environment variable or a file
+type Secret struct {
+	Value string
+	Env   string // Name of the environment variable holding the secret
+	File  string // Path of a file holding the secret (surrounding whitespace is ignored)
+}
+
+// IsSet returns true if the secret has been configured
+func (secret Secret) IsSet() bool {
+	return secret.Value != "" || secret.Env != "" || secret.File != ""
+}
+
+// Bytes returns the secret, or an error if it's not set or can't be read
+func (secret Secret) Bytes() ([]byte, error) {
+	var value string
+
+	switch {
+	case secret.File != "":
+		b, err := ioutil.ReadFile(secret.File)
+		if err != nil {
+			return nil, err
+		}
+		value = strings.TrimSpace(string(b))
+	case secret.Env != "":
+		value = os.Getenv(secret.Env)
+	default:
+		value = secret.Value
+	}
+
+	if value == "" {
+		return nil, fmt.Errorf("secret is empty")
+	}
+
+	return []byte(value), nil
+}
@@ -2,13 +2,19 @@ package stitcher
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/mailgun/groupcache/v2"
 )
 
 type Stitcherd struct {
@@ -19,64 +25,156 @@ type Stitcherd struct {
 	AdminHostName    string
     AdminEnabled     bool
 
-	hosts            map[string]*Host
+	// Serve the Prometheus metrics on their own listener (as well as on the admin host)
+	MetricsAddress   string
+
+	Tracing          TracingOptions
+	Logging          LoggingOptions
+
+	// How long SIGTERM (or SIGINT) waits for requests to finish, defaults to 15s
+	ShutdownTimeout  time.Duration
+
+	// How long SIGTERM keeps serving, while not ready, before draining
+	DrainDelay       time.Duration
+
+	// Reload hosts as their files change (for development)
+	Watch            WatchOptions
+
+	hosts            *hostRegistry
+	hostsLock        sync.RWMutex      // Guards the host files, held while loading them
+	hostFiles        map[string]string // --host file -> the Hostname it configured
+	hostConfigFiles  []string
 	adminRouter      *mux.Router
+
+	started          time.Time
+	hostsLoaded      atomic.Bool
+	cacheListening   atomic.Bool
+	draining         atomic.Bool
+	reloads          *reloadBroker // Browsers to reload, with Watch.LiveReload
+
+	// Done once shutting down, ending the live fragment streams (which would
+	// otherwise hold up the drain)
+	streams          context.Context
+	stopStreams      context.CancelFunc
+
+	failedHostFiles  map[string]bool // --host files that failed to load (and haven't since)
+	failedLock       sync.Mutex
 }
 
 // Performs initialization
 func (stitcherd *Stitcherd) Init() *Stitcherd {
 
-	stitcherd.hosts = make(map[string]*Host)
+	stitcherd.hosts = newHostRegistry()
+	stitcherd.hostFiles = make(map[string]string)
+	stitcherd.failedHostFiles = make(map[string]bool)
+	stitcherd.started = time.Now()
+	stitcherd.streams, stitcherd.stopStreams = context.WithCancel(context.Background())
+
+	if err := InitLogging(stitcherd.Logging); err != nil {
+		slog.Error("Error initializing logging", "error", err)
+	}
+
+	if err := InitTracing(stitcherd.Tracing); err != nil {
+		slog.Error("Error initializing tracing", "error", err)
+	}
 
 	if stitcherd.AdminEnabled {
 		stitcherd.adminRouter = mux.NewRouter().Host(stitcherd.AdminHostName).Subrouter()
 		stitcherd.adminRouter.HandleFunc("/hosts/load/{filename:.*}", stitcherd.AdminHandler())
+		stitcherd.adminRouter.HandleFunc("/hosts/unload/{hostname}", stitcherd.UnloadHandler).Methods(http.MethodPost, http.MethodDelete)
+		stitcherd.adminRouter.HandleFunc("/hosts", stitcherd.HostsHandler).Methods(http.MethodGet)
+		stitcherd.adminRouter.Handle(MetricsPath, MetricsHandler())
+		stitcherd.adminRouter.HandleFunc(StatusPath, stitcherd.StatusHandler)
 	}
 
+	registerCacheCollector(stitcherd.Hosts)
+
 	return stitcherd
 }
 
 func (stitcherd *Stitcherd) ServeHTTP(w http.ResponseWriter, request *http.Request) {
 
-	var host *Host = nil
+	if isHealthPath(request.URL.Path) {
+		stitcherd.HealthHandler(w, request)
+		return
+	}
 
-	log.Printf("Request for Host: '%s'\n", request.Host)
+	if stitcherd.reloads != nil && isReloadPath(request.URL.Path) {
+		stitcherd.reloads.ServeHTTP(w, request)
+		return
+	}
 
-	// Find a valid host matching request.host
-	for _, h := range stitcherd.hosts {
-		if h.Match(request.Host) {
-			host = h 
-			break
-		}
+	slog.Debug("Request", "host", request.Host, "method", request.Method, "path", request.URL.Path)
+
+	if request.URL.Path == LivePath {
+		ctx, cancel := context.WithCancel(request.Context())
+		stop := context.AfterFunc(stitcherd.streams, cancel)
+		defer stop()
+		defer cancel()
+		request = request.WithContext(ctx)
 	}
 
-	if host != nil {
-		log.Printf("Processing...\n")
-		host.Router.ServeHTTP(w, request)
-		log.Printf("Done\n")
+	// The admin end points go first, a Default host would otherwise take them
+	if stitcherd.isAdminRequest(request) {
+		stitcherd.adminRouter.ServeHTTP(w, request)
+		return
+	}
+
+	if host := stitcherd.serving(request.Host); host != nil {
+		defer host.release()
+
+		request, span := startRequestSpan(request)
+		request, stats := withRequestStats(request)
+		start := time.Now()
+		recorder := &statusWriter{ResponseWriter: w}
+		host.Router.ServeHTTP(recorder, request)
+		observeRequest(host, request, recorder.status, start)
+		endRequestSpan(span, recorder.status)
+		logAccess(host, request, recorder, stats, start)
 	} else if stitcherd.adminRouter != nil {
 		stitcherd.adminRouter.ServeHTTP(w, request)
 	} else {
-		log.Printf("No handler, 404\n")
+		slog.Debug("No host, 404", "host", request.Host)
 		w.WriteHeader(http.StatusNotFound)
         w.Write([]byte("404 - Not found\n"))
 	}
 }
 
-// RunStictcherd serves up sites specified in hosts
-func (stitcherd *Stitcherd) Run(hostConfigFiles []string) {
-	log.Printf("Start - admin hostname: '%s', working directory: '%s'\n", 
-		stitcherd.AdminHostName, stitcherd.WorkingDirectory)
+// isAdminRequest returns true if request is for one of the admin end points
+func (stitcherd *Stitcherd) isAdminRequest(request *http.Request) bool {
+	if stitcherd.adminRouter == nil {
+		return false
+	}
 
-	for _, file := range hostConfigFiles {
-		host, err := NewHostFromFile(file) 
-		if err == nil {
-			stitcherd.SetHost(host)
+	var match mux.RouteMatch
+	return stitcherd.adminRouter.Match(request, &match) || match.MatchErr == mux.ErrMethodMismatch
+}
+
+// serving returns the host to serve hostname, counting the request (see
+// Host.acquire), or nil if there isn't one.  A host closed between being matched
+// and counted has just been replaced, by the time it's matched again.
+func (stitcherd *Stitcherd) serving(hostname string) *Host {
+	for tries := 0; tries < 3; tries++ {
+		host := stitcherd.hosts.Match(hostname)
+		if host == nil || host.acquire() {
+			return host
 		}
 	}
+	return nil
+}
+
+// RunStictcherd serves up sites specified in hosts
+func (stitcherd *Stitcherd) Run(hostConfigFiles []string) {
+	slog.Info("Start", "admin_hostname", stitcherd.AdminHostName, "working_directory", stitcherd.WorkingDirectory)
+
+	stitcherd.hostConfigFiles = hostConfigFiles
+	stitcherd.Reload()
+	stitcherd.hostsLoaded.Store(true)
 
 	cacheService := InitCache()
-	defer cacheService.Shutdown(context.Background())
+	stitcherd.cacheListening.Store(true)
+
+	servers := []*http.Server{cacheService}
 
 	srv := &http.Server{
 		Addr: stitcherd.ListenAddress,
@@ -86,23 +184,181 @@ func (stitcherd *Stitcherd) Run(hostConfigFiles []string) {
 		ReadTimeout:  time.Second * 15,
 		IdleTimeout:  time.Second * 60,
 
-		//		Stictcherd: Stictcherds.CombinedLoggingStictcherd(os.Stderr, Stictcherds.RecoveryStictcherd()(r)), // Pass our instance of gorilla/mux in.
 		Handler: handlers.RecoveryHandler()(stitcherd),
 	}
 
+	handler, err := combinedLog(stitcherd.Logging.AccessLog, srv.Handler)
+	if err != nil {
+		slog.Error("Error opening access log", "file", stitcherd.Logging.AccessLog, "error", err)
+	} else {
+		srv.Handler = handler
+	}
+
+	if stitcherd.MetricsAddress != "" {
+		metrics := http.NewServeMux()
+		metrics.Handle(MetricsPath, MetricsHandler())
+		metrics.HandleFunc(LivenessPath, stitcherd.HealthHandler)
+		metrics.HandleFunc(ReadinessPath, stitcherd.HealthHandler)
+
+		metricsService := &http.Server{Addr: stitcherd.MetricsAddress, Handler: metrics}
+		servers = append(servers, metricsService)
+
+		go func() {
+			slog.Info("Serving metrics", "address", stitcherd.MetricsAddress, "path", MetricsPath)
+			if err := metricsService.ListenAndServe(); err != http.ErrServerClosed {
+				slog.Error("Metrics listener", "error", err)
+			}
+		}()
+	}
+
+	if stitcherd.Watch.Enabled {
+		watcher, err := stitcherd.watch()
+		if err != nil {
+			slog.Error("Error watching host files", "error", err)
+		} else {
+			defer watcher.Close()
+		}
+
+		// Otherwise open pages would hold up the drain
+		if stitcherd.reloads != nil {
+			srv.RegisterOnShutdown(stitcherd.reloads.close)
+		}
+	}
+
+	srv.RegisterOnShutdown(stitcherd.stopStreams)
+
 	// Run our Stictcherd in a goroutine so that it doesn't block.
 	go func() {
-		if err := srv.ListenAndServe(); err != nil {
-			log.Println(err)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			slog.Error("Listener", "error", err)
 		}
 	}()
 
-	WaitForSignal(srv)
+	// The main listener is drained first, its requests may still need the cache
+	stitcherd.WaitForSignal(append([]*http.Server{srv}, servers...))
+
+	for _, host := range stitcherd.Hosts() {
+		host.Close()
+	}
+}
+
+// Hosts returns the hosts being served, in match order
+func (stitcherd *Stitcherd) Hosts() []*Host {
+	return stitcherd.hosts.All()
+}
+
+// Reload (re)loads the --host files, swapping the new hosts in all at once.
+// A file that fails to load keeps its current host, if it has one.  Cached
+// fragments survive as the hosts' groupcache groups are reused.
+func (stitcherd *Stitcherd) Reload() {
+	stitcherd.hostsLock.RLock()
+	files := append([]string(nil), stitcherd.hostConfigFiles...)
+	stitcherd.hostsLock.RUnlock()
+
+	stitcherd.load(files, false)
+}
+
+// load (re)loads files as Reload does, returning the errors of those that
+// failed by file.  With emptyCaches the hosts that load start with empty caches.
+func (stitcherd *Stitcherd) load(files []string, emptyCaches bool) map[string]error {
+	loaded := make(map[string]*Host)
+	failed := make(map[string]error)
+
+	for _, file := range files {
+		host, err := NewHostFromFile(file)
+		if err != nil {
+			slog.Error("Keeping the current host for file", "file", file, "error", err)
+			stitcherd.hostFileFailed(file, true)
+			failed[file] = err
+			continue
+		}
+		loaded[file] = host
+	}
+
+	stitcherd.hostsLock.Lock()
+
+	// Only now the hosts have loaded, so a failed load leaves the current
+	// host's cache alone, and under the lock so requests go from the old
+	// host (with the old group) to the new one (with the new group)
+	if emptyCaches {
+		for _, host := range loaded {
+			host.emptyCache()
+		}
+	}
+
+	var hosts []*Host
+	var removed []string
+
+	for file, host := range loaded {
+		// The file may now configure a different host
+		if previous, ok := stitcherd.hostFiles[file]; ok && previous != host.Hostname {
+			removed = append(removed, previous)
+		}
+
+		hosts = append(hosts, host)
+		stitcherd.hostFiles[file] = host.Hostname
+	}
+	replaced := stitcherd.hosts.update(hosts, removed)
+
+	stitcherd.hostsLock.Unlock()
+
+	for file, host := range loaded {
+		stitcherd.hostFileFailed(file, false)
+		slog.Info("Loaded host", "file", file, "host", host.Hostname)
+	}
+
+	for _, old := range replaced {
+		old.Close()
+	}
+
+	return failed
 }
 
 // Add or replace a host for the Stictcherd
 func (stitcherd *Stitcherd) SetHost(host *Host) {
-	stitcherd.hosts[host.Hostname] = host
+	for _, old := range stitcherd.hosts.update([]*Host{host}, nil) {
+		old.Close()
+	}
+}
+
+// Unload stops serving the host with hostname (and forgets its --host file,
+// so reloads don't bring it back).  Returns false if there's no such host.
+func (stitcherd *Stitcherd) Unload(hostname string) bool {
+	stitcherd.hostsLock.Lock()
+
+	replaced := stitcherd.hosts.update(nil, []string{hostname})
+
+	files := stitcherd.hostConfigFiles[:0]
+	for _, file := range stitcherd.hostConfigFiles {
+		if stitcherd.hostFiles[file] == hostname {
+			delete(stitcherd.hostFiles, file)
+			stitcherd.hostFileFailed(file, false)
+			continue
+		}
+		files = append(files, file)
+	}
+	stitcherd.hostConfigFiles = files
+
+	stitcherd.hostsLock.Unlock()
+
+	for _, old := range replaced {
+		old.Close()
+		groupcache.DeregisterGroup(old.Hostname)
+	}
+
+	return len(replaced) > 0
+}
+
+// fileHost returns the host the --host file configured, if any
+func (stitcherd *Stitcherd) fileHost(file string) *Host {
+	stitcherd.hostsLock.RLock()
+	hostname, ok := stitcherd.hostFiles[file]
+	stitcherd.hostsLock.RUnlock()
+
+	if !ok {
+		return nil
+	}
+	return stitcherd.hosts.Get(hostname)
 }
 
 // Returns an AdminHandler func
@@ -112,20 +368,105 @@ func (stitcherd *Stitcherd) AdminHandler() func(http.ResponseWriter, *http.Reque
 
 		filename := vars["filename"]
 
-		log.Printf("AdminHandler: New Host File?: '%s'\n", filename)
+		slog.Info("AdminHandler: loading host file", "file", filename)
+
+		err := stitcherd.load([]string{filename}, false)[filename]
 
-		host, err := NewHostFromFile(filename) 
+		// New files are reloaded along with the --host files from now on
+		stitcherd.hostsLock.Lock()
+		known := slices.Contains(stitcherd.hostConfigFiles, filename)
+		if err == nil && !known {
+			stitcherd.hostConfigFiles = append(stitcherd.hostConfigFiles, filename)
+		}
+		stitcherd.hostsLock.Unlock()
+
+		if err != nil && !known {
+			stitcherd.hostFileFailed(filename, false)
+		}
 
 		if err == nil {
-			stitcherd.SetHost(host)
 			w.WriteHeader(http.StatusOK)
 			fmt.Fprintf(w, "Filename: %v OK\n", vars["filename"])
-			log.Printf("AdminHandler: (re)Loaded %s\n", filename)
+			slog.Info("AdminHandler: (re)loaded host file", "file", filename)
   	} else {
-			log.Printf("AdminHandler: Error Loading %s, %v\n", filename, err)
+			slog.Error("AdminHandler: error loading host file", "file", filename, "error", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(w, "filename: %v ERROR '%v'\n", vars["filename"], err)
 		}
 	}
 }
 
+// UnloadHandler stops serving the host named in the path
+func (stitcherd *Stitcherd) UnloadHandler(w http.ResponseWriter, r *http.Request) {
+	hostname := mux.Vars(r)["hostname"]
+
+	if !stitcherd.Unload(hostname) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "hostname: %v not loaded\n", hostname)
+		return
+	}
+
+	slog.Info("AdminHandler: unloaded host", "host", hostname)
+	fmt.Fprintf(w, "Hostname: %v unloaded\n", hostname)
+}
+
+type hostListing struct {
+	Hostname string   `json:"hostname"`
+	Aliases  []string `json:"aliases,omitempty"`
+	Priority int      `json:"priority"`
+	Default  bool     `json:"default,omitempty"`
+	File     string   `json:"file,omitempty"`
+}
+
+// HostsHandler lists the hosts, in match order, as JSON
+func (stitcherd *Stitcherd) HostsHandler(w http.ResponseWriter, r *http.Request) {
+	files := make(map[string]string)
+	stitcherd.hostsLock.RLock()
+	for file, hostname := range stitcherd.hostFiles {
+		files[hostname] = file
+	}
+	stitcherd.hostsLock.RUnlock()
+
+	listing := []hostListing{}
+	for _, host := range stitcherd.Hosts() {
+		listing = append(listing, hostListing{
+			Hostname: host.Hostname,
+			Aliases:  host.Aliases,
+			Priority: host.Priority,
+			Default:  host.Default,
+			File:     files[host.Hostname],
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(listing)
+}
+
+// hostFileFailed records whether a host file failed to load, for readiness
+func (stitcherd *Stitcherd) hostFileFailed(file string, failed bool) {
+	stitcherd.failedLock.Lock()
+	defer stitcherd.failedLock.Unlock()
+
+	if failed {
+		stitcherd.failedHostFiles[file] = true
+	} else {
+		delete(stitcherd.failedHostFiles, file)
+	}
+}
+
+// failedFiles returns the host files that failed to load
+func (stitcherd *Stitcherd) failedFiles() []string {
+	stitcherd.failedLock.Lock()
+	defer stitcherd.failedLock.Unlock()
+
+	files := make([]string, 0, len(stitcherd.failedHostFiles))
+	for file := range stitcherd.failedHostFiles {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	return files
+}
@@ -0,0 +1,500 @@
+package stitcher
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers backends send to change the session
+const (
+	// Form encoded values to set, eg "user_id=42&name=Jane%20Doe"
+	SessionSetHeader = "Stitcherd-Session-Set"
+
+	// Comma separated keys to remove, or "*" for all of them
+	SessionDeleteHeader = "Stitcherd-Session-Delete"
+)
+
+const (
+	defaultSessionCookie = "stitcherd_session"
+	defaultSessionMaxAge = 24 * time.Hour
+
+	defaultMaxMemorySessions = 100000
+)
+
+// SessionOptions configures a host's sessions.  Session values are in the fetch
+// context as session.<key>, eg {{session.user_id}}, and in templates as .session
+type SessionOptions struct {
+	// Where sessions are kept: "cookie" (the default, encrypted and signed in
+	// the cookie itself), "memory" or "file"
+	Store string
+
+	Secret    Secret // Encrypts cookie sessions, a random key is used if not set
+	Directory string // Where "file" sessions are kept
+
+	MaxAge string // Eg "1h", defaults to 24h
+
+	// The most sessions the "memory" store keeps, those closest to expiring
+	// are dropped to make room.  Defaults to 100,000.
+	MaxSessions int
+
+	// Cookie attributes
+	CookieName string // Defaults to stitcherd_session
+	Domain     string
+	Path       string // Defaults to /
+	Secure     bool   // Always set for requests over TLS
+	SameSite   string // "lax" (the default), "strict" or "none"
+}
+
+// Session holds the values of a visitor's session
+type Session struct {
+	id      string
+	values  map[string]string
+	changed bool
+	lock    sync.Mutex
+}
+
+// Get returns the value of key (or "" if it's not set)
+func (session *Session) Get(key string) string {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return session.values[key]
+}
+
+// Set sets key to value
+func (session *Session) Set(key, value string) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.values[key] = value
+	session.changed = true
+}
+
+// Delete removes key or, if key is "*", all of the values but stitcherd's own
+// (starting with _, eg the logged in user)
+func (session *Session) Delete(key string) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if key == "*" {
+		for k := range session.values {
+			if !strings.HasPrefix(k, "_") {
+				delete(session.values, k)
+			}
+		}
+	} else {
+		delete(session.values, key)
+	}
+	session.changed = true
+}
+
+// Renew gives the session a new id when it's next saved (eg on logging in)
+func (session *Session) Renew() {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.id = ""
+	session.changed = true
+}
+
+// Values returns a copy of the session's values
+func (session *Session) Values() map[string]string {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	values := make(map[string]string, len(session.values))
+	for k, v := range session.values {
+		values[k] = v
+	}
+	return values
+}
+
+// sessionStore loads and saves session values from and to the cookie value
+type sessionStore interface {
+	Load(cookie string) (id string, values map[string]string)
+	Save(id string, values map[string]string) (cookie string, err error)
+}
+
+// initSessions creates the host's session store
+func (host *Host) initSessions() {
+	options := host.Sessions
+
+	maxAge := defaultSessionMaxAge
+	if options.MaxAge != "" {
+		var err error
+		if maxAge, err = time.ParseDuration(options.MaxAge); err != nil {
+			slog.Error("Invalid session MaxAge", "host", host.Hostname, "max_age", options.MaxAge, "error", err)
+			maxAge = defaultSessionMaxAge
+		}
+	}
+	host.sessionMaxAge = maxAge
+
+	switch options.Store {
+	case "memory":
+		maxSessions := options.MaxSessions
+		if maxSessions <= 0 {
+			maxSessions = defaultMaxMemorySessions
+		}
+		host.sessionStore = &memorySessionStore{sessions: make(map[string]memorySession), maxAge: maxAge, maxSessions: maxSessions}
+	case "file":
+		if err := os.MkdirAll(options.Directory, 0700); err != nil {
+			slog.Error("Error creating session directory", "directory", options.Directory, "error", err)
+		}
+		host.sessionStore = &fileSessionStore{directory: options.Directory, maxAge: maxAge}
+	default:
+		key, err := options.Secret.Bytes()
+		if err != nil {
+			slog.Warn("No session secret, sessions won't survive restarts", "host", host.Hostname, "error", err)
+			key = make([]byte, 32)
+			rand.Read(key)
+		}
+		host.sessionStore = newCookieSessionStore(key, maxAge)
+	}
+}
+
+// LoadSession returns the request's session (a new, empty, one if it doesn't have one)
+func (host *Host) LoadSession(r *http.Request) *Session {
+	session := &Session{values: make(map[string]string)}
+
+	if cookie, err := r.Cookie(host.sessionCookieName()); err == nil {
+		id, values := host.sessionStore.Load(cookie.Value)
+		if values != nil {
+			session.id, session.values = id, values
+		}
+	}
+
+	return session
+}
+
+// SaveSession stores the session in the context, if it has changed, and sets
+// its cookie.  It must be called before the response is written.  Errors are
+// logged, and returned for callers that can't go on without the session (eg
+// logins, which would otherwise loop).
+func (host *Host) SaveSession(w http.ResponseWriter, r *http.Request, contextdata map[string]interface{}) error {
+	session, ok := contextdata["_session"].(*Session)
+	if !ok || host.sessionStore == nil {
+		return nil
+	}
+
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	if !session.changed {
+		return nil
+	}
+
+	value, err := host.sessionStore.Save(session.id, session.values)
+	if err != nil {
+		slog.Error("Error saving session", "error", err)
+		return err
+	}
+	session.changed = false
+
+	options := host.Sessions
+
+	path := options.Path
+	if path == "" {
+		path = "/"
+	}
+
+	sameSite := http.SameSiteLaxMode
+	switch strings.ToLower(options.SameSite) {
+	case "strict":
+		sameSite = http.SameSiteStrictMode
+	case "none":
+		sameSite = http.SameSiteNoneMode
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     host.sessionCookieName(),
+		Value:    value,
+		Domain:   options.Domain,
+		Path:     path,
+		MaxAge:   int(host.sessionMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   options.Secure || r.TLS != nil || sameSite == http.SameSiteNoneMode,
+		SameSite: sameSite,
+	})
+
+	return nil
+}
+
+func (host *Host) sessionCookieName() string {
+	if host.Sessions.CookieName != "" {
+		return host.Sessions.CookieName
+	}
+	return defaultSessionCookie
+}
+
+// UpdateSession applies a backend's session headers to the session in the context
+func UpdateSession(header http.Header, contextdata map[string]interface{}) {
+	session, ok := contextdata["_session"].(*Session)
+	if !ok {
+		return
+	}
+
+	for _, deletes := range header.Values(SessionDeleteHeader) {
+		for _, key := range strings.Split(deletes, ",") {
+			if key = strings.TrimSpace(key); key != "" && !strings.HasPrefix(key, "_") {
+				session.Delete(key)
+			}
+		}
+	}
+
+	for _, sets := range header.Values(SessionSetHeader) {
+		values, err := url.ParseQuery(sets)
+		if err != nil {
+			slog.Warn("Invalid session header", "header", SessionSetHeader, "error", err)
+			continue
+		}
+		for key := range values {
+			// Keys starting with _ are stitcherd's own (eg the logged in user)
+			if strings.HasPrefix(key, "_") {
+				continue
+			}
+			session.Set(key, values.Get(key))
+		}
+	}
+}
+
+// setSessionContext (re)sets the session.<key> values in the context
+func setSessionContext(contextdata map[string]interface{}, session *Session) {
+	deletePrefixed(contextdata, "session.")
+
+	for key, value := range session.Values() {
+		if !strings.HasPrefix(key, "_") {
+			contextdata["session."+key] = value
+		}
+	}
+}
+
+// deletePrefixed removes the context values with keys starting with prefix
+func deletePrefixed(contextdata map[string]interface{}, prefix string) {
+	for key := range contextdata {
+		if strings.HasPrefix(key, prefix) {
+			delete(contextdata, key)
+		}
+	}
+}
+
+func newSessionID() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// cookieSessionStore keeps the values in the cookie, encrypted (and
+// authenticated) with AES-GCM
+type cookieSessionStore struct {
+	aead   cipher.AEAD
+	maxAge time.Duration
+}
+
+// cookieSession is what's encrypted into the cookie
+type cookieSession struct {
+	Values  map[string]string `json:"v"`
+	Expires int64             `json:"e"`
+}
+
+func newCookieSessionStore(secret []byte, maxAge time.Duration) *cookieSessionStore {
+	key := sha256.Sum256(secret)
+	block, _ := aes.NewCipher(key[:])
+	aead, _ := cipher.NewGCM(block)
+	return &cookieSessionStore{aead: aead, maxAge: maxAge}
+}
+
+func (store *cookieSessionStore) Load(cookie string) (string, map[string]string) {
+	sealed, err := base64.RawURLEncoding.DecodeString(cookie)
+	if err != nil || len(sealed) < store.aead.NonceSize() {
+		return "", nil
+	}
+
+	nonce, ciphertext := sealed[:store.aead.NonceSize()], sealed[store.aead.NonceSize():]
+	plaintext, err := store.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", nil
+	}
+
+	var session cookieSession
+	if err := json.Unmarshal(plaintext, &session); err != nil || time.Now().Unix() > session.Expires {
+		return "", nil
+	}
+
+	return "", session.Values
+}
+
+func (store *cookieSessionStore) Save(id string, values map[string]string) (string, error) {
+	plaintext, err := json.Marshal(cookieSession{Values: values, Expires: time.Now().Add(store.maxAge).Unix()})
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, store.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := store.aead.Seal(nonce, nonce, plaintext, nil)
+	if len(sealed) > 3000 {
+		return "", fmt.Errorf("session too large for a cookie")
+	}
+
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// memorySessionStore keeps the values in memory, keyed by a random id in the cookie
+type memorySessionStore struct {
+	sessions    map[string]memorySession
+	maxAge      time.Duration
+	maxSessions int
+	lock        sync.Mutex
+}
+
+type memorySession struct {
+	values  map[string]string
+	expires time.Time
+}
+
+func (store *memorySessionStore) Load(cookie string) (string, map[string]string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	session, ok := store.sessions[cookie]
+	if !ok || time.Now().After(session.expires) {
+		delete(store.sessions, cookie)
+		return "", nil
+	}
+
+	values := make(map[string]string, len(session.values))
+	for k, v := range session.values {
+		values[k] = v
+	}
+
+	return cookie, values
+}
+
+func (store *memorySessionStore) Save(id string, values map[string]string) (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	// Expired sessions are dropped as new ones come in
+	now := time.Now()
+	if id == "" {
+		id = newSessionID()
+		for key, session := range store.sessions {
+			if now.After(session.expires) {
+				delete(store.sessions, key)
+			}
+		}
+		if len(store.sessions) >= store.maxSessions {
+			store.evict()
+		}
+	}
+
+	copied := make(map[string]string, len(values))
+	for k, v := range values {
+		copied[k] = v
+	}
+	store.sessions[id] = memorySession{values: copied, expires: now.Add(store.maxAge)}
+
+	return id, nil
+}
+
+// evict drops the session closest to expiring
+func (store *memorySessionStore) evict() {
+	var oldest string
+	var expires time.Time
+
+	for key, session := range store.sessions {
+		if oldest == "" || session.expires.Before(expires) {
+			oldest, expires = key, session.expires
+		}
+	}
+
+	delete(store.sessions, oldest)
+}
+
+// fileSessionStore keeps the values in a JSON file per session, named by a random id in the cookie
+type fileSessionStore struct {
+	directory string
+	maxAge    time.Duration
+}
+
+func (store *fileSessionStore) path(id string) (string, bool) {
+	if len(id) != 64 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(id); err != nil {
+		return "", false
+	}
+	return filepath.Join(store.directory, id+".json"), true
+}
+
+func (store *fileSessionStore) Load(cookie string) (string, map[string]string) {
+	path, ok := store.path(cookie)
+	if !ok {
+		return "", nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", nil
+	}
+
+	if time.Since(info.ModTime()) > store.maxAge {
+		os.Remove(path)
+		return "", nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", nil
+	}
+
+	var values map[string]string
+	if err := json.Unmarshal(b, &values); err != nil {
+		return "", nil
+	}
+
+	return cookie, values
+}
+
+func (store *fileSessionStore) Save(id string, values map[string]string) (string, error) {
+	if id == "" {
+		id = newSessionID()
+	}
+
+	path, _ := store.path(id)
+
+	b, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+
+	// Written to a temporary file first so concurrent loads never see part of it
+	tmp, err := ioutil.TempFile(store.directory, id+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return id, os.Rename(tmp.Name(), path)
+}
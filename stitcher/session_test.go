@@ -0,0 +1,49 @@
+package stitcher
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestUpdateSessionDeleteAllKeepsOwnValues(t *testing.T) {
+	session := &Session{values: map[string]string{sessionUserKey: "jane", "cart": "3", "coupon": "x"}}
+	contextdata := map[string]interface{}{"_session": session}
+
+	header := http.Header{}
+	header.Set(SessionDeleteHeader, "*")
+	UpdateSession(header, contextdata)
+
+	values := session.Values()
+	if values[sessionUserKey] != "jane" {
+		t.Errorf("backend logged the user out: %v", values)
+	}
+	if len(values) != 1 {
+		t.Errorf("backend values not cleared: %v", values)
+	}
+}
+
+func TestMemorySessionStoreBounded(t *testing.T) {
+	store := &memorySessionStore{sessions: make(map[string]memorySession), maxAge: time.Hour, maxSessions: 2}
+
+	first, _ := store.Save("", map[string]string{"n": "1"})
+	second, _ := store.Save("", map[string]string{"n": "2"})
+	third, _ := store.Save("", map[string]string{"n": "3"})
+
+	if len(store.sessions) != 2 {
+		t.Errorf("%d sessions kept, want 2", len(store.sessions))
+	}
+	if _, values := store.Load(first); values != nil {
+		t.Errorf("oldest session kept")
+	}
+	for _, id := range []string{second, third} {
+		if _, values := store.Load(id); values == nil {
+			t.Errorf("newer session %s dropped", id)
+		}
+	}
+
+	// Existing sessions are saved without dropping any
+	if _, err := store.Save(second, map[string]string{"n": "2b"}); err != nil || len(store.sessions) != 2 {
+		t.Errorf("resaving: %v, %d sessions", err, len(store.sessions))
+	}
+}
@@ -2,26 +2,54 @@ package stitcher
 
 import (
 	"context"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 )
 
-// WaitForSignal blocks until SIGINT arrives.
-func WaitForSignal(srv *http.Server) {
+const defaultShutdownTimeout = 15 * time.Second
+
+// WaitForSignal blocks until SIGINT or SIGTERM arrives, then drains servers
+// (in order) within ShutdownTimeout.  SIGHUP reloads the host files.
+func (stitcherd *Stitcherd) WaitForSignal(servers []*http.Server) {
 	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(c)
+
+	var sig os.Signal
+	for sig = range c {
+		if sig != syscall.SIGHUP {
+			slog.Info("Shutting down", "signal", sig)
+			break
+		}
+
+		slog.Info("Reloading host files", "signal", sig)
+		stitcherd.Reload()
+	}
 
-	// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C)
-	// SIGKILL, SIGQUIT or SIGTERM (Ctrl+/) will not be caught.
-	signal.Notify(c, os.Interrupt)
+	// Tell load balancers to stop sending us requests, and give them time to
+	// notice (serving as usual) before the listeners close.  Not for SIGINT
+	// (eg Ctrl-C in a terminal), and a second signal cuts it short.
+	stitcherd.draining.Store(true)
 
-	// Block until we receive our signal.
-	<-c
+	if sig == syscall.SIGTERM && stitcherd.DrainDelay > 0 {
+		slog.Info("Not ready, waiting before draining", "delay", stitcherd.DrainDelay)
 
-	var wait time.Duration
-	wait = time.Second * 15
+		delay := time.NewTimer(stitcherd.DrainDelay)
+		select {
+		case <-delay.C:
+		case <-c:
+			delay.Stop()
+		}
+	}
+
+	wait := stitcherd.ShutdownTimeout
+	if wait <= 0 {
+		wait = defaultShutdownTimeout
+	}
 
 	// Create a deadline to wait for.
 	ctx, cancel := context.WithTimeout(context.Background(), wait)
@@ -29,11 +57,14 @@ func WaitForSignal(srv *http.Server) {
 
 	// Doesn't block if no connections, but will otherwise wait
 	// until the timeout deadline.
-	srv.Shutdown(ctx)
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Warn("Listener did not drain", "address", srv.Addr, "error", err)
+		}
+	}
+
+	// Export any spans still batched
+	shutdownTracing(ctx)
 
-	// Optionally, you could run srv.Shutdown in a goroutine and block on
-	// <-ctx.Done() if your application should wait for other services
-	// to finalize based on context cancellation.
-	log.Println("shutting down")
-	os.Exit(0)
+	slog.Info("Shut down")
 }
@@ -0,0 +1,123 @@
+package stitcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite" // Registers the "sqlite" database/sql driver
+)
+
+const defaultSQLTimeout = 5 * time.Second
+
+// SQLOptions configures the "sql" fetcher type.  The fetcher's Source is the
+// database DSN, eg "file:data/shop.db?mode=ro", which (unlike other Sources)
+// isn't interpolated.
+type SQLOptions struct {
+	Driver string // database/sql driver name, defaults to "sqlite"
+	Query  string // Eg "SELECT price, stock FROM products WHERE sku = ?"
+
+	// Names of the fetch context values bound, in order, to the Query's
+	// placeholders.  A name missing from the context is a fetch error.
+	Params []string
+
+	// Return the first row as a JSON object (suitable for a RouteDataFragment)
+	// instead of an array of all rows.
+	SingleRow bool
+
+	Timeout string // Eg "500ms", defaults to 5s
+}
+
+// FetchSQL runs the Query against the database at dsn and returns the
+// resulting rows as JSON.
+func (fetcher *FragmentFetcher) FetchSQL(site *Host, dsn string, contextdata map[string]interface{}) (string, error) {
+	options := fetcher.SQL
+
+	driver := options.Driver
+	if driver == "" {
+		driver = "sqlite"
+	}
+
+	timeout := defaultSQLTimeout
+	if options.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(options.Timeout); err != nil {
+			return "", fmt.Errorf("sql: invalid timeout: %v", err)
+		}
+	}
+
+	db, err := site.Database(driver, dsn)
+	if err != nil {
+		return "", err
+	}
+
+	args := make([]interface{}, len(options.Params))
+	for i, name := range options.Params {
+		value, ok := contextdata[name]
+		if !ok {
+			return "", fmt.Errorf("sql: no '%s' in the fetch context", name)
+		}
+		args[i] = value
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, options.Query, args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return "", err
+	}
+
+	results := make([]map[string]interface{}, 0)
+
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+
+		if err := rows.Scan(pointers...); err != nil {
+			return "", err
+		}
+
+		row := make(map[string]interface{}, len(columns))
+		for i, column := range columns {
+			if b, ok := values[i].([]byte); ok {
+				row[column] = string(b)
+			} else {
+				row[column] = values[i]
+			}
+		}
+
+		results = append(results, row)
+
+		if options.SingleRow {
+			break
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	var content []byte
+
+	if options.SingleRow {
+		if len(results) == 0 {
+			return "{}", nil
+		}
+		content, err = json.Marshal(results[0])
+	} else {
+		content, err = json.Marshal(results)
+	}
+
+	return string(content), err
+}
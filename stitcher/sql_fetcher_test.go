@@ -0,0 +1,77 @@
+package stitcher
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// newTestDatabase returns the DSN of a temporary sqlite database of products
+func newTestDatabase(t *testing.T) string {
+	dsn := "file:" + filepath.Join(t.TempDir(), "shop.db")
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, statement := range []string{
+		"CREATE TABLE products (sku TEXT, name TEXT, price REAL, stock INTEGER)",
+		"INSERT INTO products VALUES ('abc', 'Widget', 9.5, 3), ('def', 'Gadget', 20, 0)",
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dsn
+}
+
+func TestFetchSQL(t *testing.T) {
+	dsn := newTestDatabase(t)
+
+	host := &Host{Hostname: "sql.test"}
+	host.Init()
+	defer host.Close()
+
+	contextdata := map[string]interface{}{"sku": "abc", "minStock": 1, "injection": "x' OR '1'='1"}
+
+	tests := []struct {
+		name    string
+		options SQLOptions
+		want    string
+		wantErr bool
+	}{
+		{"rows", SQLOptions{Query: "SELECT sku, stock FROM products ORDER BY sku"},
+			`[{"sku":"abc","stock":3},{"sku":"def","stock":0}]`, false},
+		{"single row", SQLOptions{Query: "SELECT name, price FROM products WHERE sku = ?", Params: []string{"sku"}, SingleRow: true},
+			`{"name":"Widget","price":9.5}`, false},
+		{"no rows", SQLOptions{Query: "SELECT name FROM products WHERE sku = 'none'"},
+			`[]`, false},
+		{"no single row", SQLOptions{Query: "SELECT name FROM products WHERE sku = 'none'", SingleRow: true},
+			`{}`, false},
+		{"params in order", SQLOptions{Query: "SELECT sku FROM products WHERE stock >= ? AND sku = ?", Params: []string{"minStock", "sku"}},
+			`[{"sku":"abc"}]`, false},
+		{"param not interpolated", SQLOptions{Query: "SELECT sku FROM products WHERE name = ?", Params: []string{"injection"}},
+			`[]`, false},
+		{"missing param", SQLOptions{Query: "SELECT sku FROM products WHERE sku = ?", Params: []string{"id"}},
+			"", true},
+		{"bad query", SQLOptions{Query: "SELECT nothing FROM nowhere"},
+			"", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fetcher := &FragmentFetcher{Type: "sql", Source: dsn, SQL: test.options}
+
+			content, err := fetcher.FetchSQL(host, dsn, contextdata)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v, want an error: %v", err, test.wantErr)
+			}
+			if content != test.want {
+				t.Errorf("got %s, want %s", content, test.want)
+			}
+		})
+	}
+}
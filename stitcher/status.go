@@ -0,0 +1,141 @@
+package stitcher
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/mailgun/groupcache/v2"
+)
+
+// StatusPath is where the admin host serves the status page (as JSON with ?format=json)
+const StatusPath = "/status"
+
+type serverStatus struct {
+	Started    time.Time    `json:"started"`
+	Uptime     string       `json:"uptime"`
+	Ready      bool         `json:"ready"`
+	Failures   []string     `json:"failures,omitempty"`
+	CacheSelf  string       `json:"cacheSelf"`
+	CachePeers []string     `json:"cachePeers"`
+	Hosts      []hostStatus `json:"hosts"`
+}
+
+type hostStatus struct {
+	Hostname string        `json:"hostname"`
+	Routes   []routeStatus `json:"routes"`
+	Cache    cacheStatus   `json:"cache"`
+}
+
+type routeStatus struct {
+	Path          string  `json:"path"`
+	RespondWith   string  `json:"respondWith"`
+	Stream        string  `json:"stream,omitempty"`
+	MaxRate       float64 `json:"maxRate,omitempty"`
+	AllowBurst    int     `json:"allowBurst,omitempty"`
+	BotMaxRate    float64 `json:"botMaxRate,omitempty"`
+	BotAllowBurst int     `json:"botAllowBurst,omitempty"`
+}
+
+type cacheStatus struct {
+	MaxBytes   int64                 `json:"maxBytes"`
+	Main       groupcache.CacheStats `json:"main"`
+	Hot        groupcache.CacheStats `json:"hot"`
+	Gets       int64                 `json:"gets"`
+	Hits       int64                 `json:"hits"`
+	Loads      int64                 `json:"loads"`
+	PeerLoads  int64                 `json:"peerLoads"`
+	PeerErrors int64                 `json:"peerErrors"`
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html><head><title>stitcherd status</title>
+<style>body{font-family:sans-serif} table{border-collapse:collapse;margin-bottom:1em} td,th{border:1px solid #ccc;padding:2px 8px;text-align:left}</style>
+</head><body>
+<h1>stitcherd</h1>
+<p>Up {{.Uptime}} (since {{.Started.Format "2006-01-02 15:04:05 MST"}}),
+{{if .Ready}}ready{{else}}<strong>not ready</strong>{{end}}</p>
+{{if .Failures}}<ul>{{range .Failures}}<li>{{.}}</li>{{end}}</ul>{{end}}
+<p>Cache {{.CacheSelf}}, peers: {{range .CachePeers}}{{.}} {{end}}</p>
+{{range .Hosts}}
+<h2>{{.Hostname}}</h2>
+<table>
+<tr><th>Path</th><th>RespondWith</th><th>Stream</th><th>Rate / Burst</th><th>Bot Rate / Burst</th></tr>
+{{range .Routes}}<tr><td>{{.Path}}</td><td>{{.RespondWith}}</td><td>{{.Stream}}</td>
+<td>{{if .MaxRate}}{{.MaxRate}} / {{.AllowBurst}}{{end}}</td><td>{{if .BotMaxRate}}{{.BotMaxRate}} / {{.BotAllowBurst}}{{end}}</td></tr>
+{{end}}</table>
+<table>
+<tr><th>Cache</th><th>Bytes</th><th>Items</th><th>Gets</th><th>Hits</th><th>Evictions</th></tr>
+<tr><td>main</td><td>{{.Cache.Main.Bytes}} / {{.Cache.MaxBytes}}</td><td>{{.Cache.Main.Items}}</td><td>{{.Cache.Main.Gets}}</td><td>{{.Cache.Main.Hits}}</td><td>{{.Cache.Main.Evictions}}</td></tr>
+<tr><td>hot</td><td>{{.Cache.Hot.Bytes}}</td><td>{{.Cache.Hot.Items}}</td><td>{{.Cache.Hot.Gets}}</td><td>{{.Cache.Hot.Hits}}</td><td>{{.Cache.Hot.Evictions}}</td></tr>
+</table>
+<p>Group: {{.Cache.Gets}} gets, {{.Cache.Hits}} hits, {{.Cache.Loads}} loads, {{.Cache.PeerLoads}} peer loads, {{.Cache.PeerErrors}} peer errors</p>
+{{end}}
+</body></html>
+`))
+
+// StatusHandler serves the admin status page
+func (stitcherd *Stitcherd) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	status := serverStatus{
+		Started:    stitcherd.started,
+		Uptime:     time.Since(stitcherd.started).Round(time.Second).String(),
+		Failures:   stitcherd.readinessFailures(r.Context()),
+		CacheSelf:  cacheSelf,
+		CachePeers: cachePeers,
+	}
+	status.Ready = len(status.Failures) == 0
+
+	for _, host := range stitcherd.Hosts() {
+		status.Hosts = append(status.Hosts, host.status())
+	}
+	sort.Slice(status.Hosts, func(i, j int) bool {
+		return status.Hosts[i].Hostname < status.Hosts[j].Hostname
+	})
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	statusTemplate.Execute(w, status)
+}
+
+func (host *Host) status() hostStatus {
+	status := hostStatus{Hostname: host.Hostname}
+
+	for _, route := range host.Routes {
+		status.Routes = append(status.Routes, routeStatus{
+			Path:          route.Path,
+			RespondWith:   route.RespondWith,
+			Stream:        route.Stream,
+			MaxRate:       route.MaxRate,
+			AllowBurst:    route.AllowBurst,
+			BotMaxRate:    route.BotMaxRate,
+			BotAllowBurst: route.BotAllowBurst,
+		})
+	}
+
+	if host.Cache != nil {
+		stats := &host.Cache.Stats
+		status.Cache = cacheStatus{
+			MaxBytes:   host.maxCache(),
+			Main:       host.Cache.CacheStats(groupcache.MainCache),
+			Hot:        host.Cache.CacheStats(groupcache.HotCache),
+			Gets:       stats.Gets.Get(),
+			Hits:       stats.CacheHits.Get(),
+			Loads:      stats.Loads.Get(),
+			PeerLoads:  stats.PeerLoads.Get(),
+			PeerErrors: stats.PeerErrors.Get(),
+		}
+	}
+
+	return status
+}
@@ -0,0 +1,276 @@
+package stitcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+const defaultStreamFlushAfter = 50 * time.Millisecond
+
+// Stream modes for Route.Stream
+const (
+	// Send the page as soon as the fast fragments are in with placeholders for
+	// the slow ones, which are streamed (in any order) at the end of the body
+	// and swapped in by a small inline script.
+	StreamOutOfOrder = "out_of_order"
+
+	// Send the page up to the first slow fragment, flushing as each one
+	// arrives (no script, but later content waits on earlier fragments).
+	StreamInOrder = "in_order"
+)
+
+// Swaps streamed markup (a JSON string, so that it can't end the script early)
+// into the [data-stitch-pending="ID"] elements.  Unlike innerHTML, scripts in
+// a contextual fragment run once inserted.
+const streamSwapScript = `<script>function stitchSwap(id,html){var f=document.createRange().createContextualFragment(html);` +
+	`document.querySelectorAll('[data-stitch-pending="'+id+'"]').forEach(function(e){e.replaceWith(f.cloneNode(true))})}</script>`
+
+type streamedFragment struct {
+	index   int
+	content string
+	err     error
+}
+
+// Stream renders the page to w, flushing the page (and whichever of its
+// fragments are ready) after flushAfter and then streaming the remaining
+// fragments as they complete.  The page itself is never cached as a whole
+// when streamed, though its fragments are.
+func (page *FragmentedPage) Stream(site *Host, w io.Writer, contextdata map[string]interface{}, mode string, flushAfter time.Duration) error {
+	fragment := &page.Fragment
+
+	if flushAfter <= 0 {
+		flushAfter = defaultStreamFlushAfter
+	}
+
+	flush := func() {
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+
+	results := make(chan streamedFragment, len(fragment.Fragments))
+
+	for i := range fragment.Fragments {
+		// Each renders concurrently (with the page), with its own copy of the context
+		go func(i int, contextdata map[string]interface{}) {
+			content, err := fragment.Fragments[i].Content(site, contextdata)
+			if err != nil {
+				logFragmentError(contextdata, &fragment.Fragments[i], err)
+			}
+			results <- streamedFragment{index: i, content: content, err: err}
+		}(i, copyContext(contextdata))
+	}
+
+	this_doc, err := fragment.Document(site, contextdata)
+	if err != nil {
+		return err
+	}
+
+	// Whatever arrives before the deadline goes straight into the page
+	pending := make(map[int]bool, len(fragment.Fragments))
+	for i := range fragment.Fragments {
+		pending[i] = true
+	}
+
+	deadline := time.After(flushAfter)
+
+waiting:
+	for len(pending) > 0 {
+		select {
+		case result := <-results:
+			delete(pending, result.index)
+			if result.err == nil {
+				page.applyStreamed(this_doc, result)
+			}
+		case <-deadline:
+			break waiting
+		}
+	}
+
+	// Only replace transforms can be streamed, fragments with others go in
+	// the page (as if it weren't streamed) however long they take
+	for page.awaitingUnstreamable(pending) {
+		result := <-results
+		delete(pending, result.index)
+		if result.err == nil {
+			page.applyStreamed(this_doc, result)
+		}
+	}
+
+	// Mark the insertion points of the rest
+	for i := range pending {
+		for j, transformation := range fragment.Fragments[i].DocumentTransforms {
+			if transformation.Type != "replace" || transformation.ParentSelector == "" {
+				continue
+			}
+
+			id := fmt.Sprintf("%d-%d", i, j)
+			if mode == StreamInOrder {
+				this_doc.Find(transformation.ParentSelector).ReplaceWithHtml("<!--stitch-pending:" + id + "-->")
+			} else {
+				this_doc.Find(transformation.ParentSelector).SetAttr("data-stitch-pending", id)
+			}
+		}
+	}
+
+	for _, transformation := range fragment.TransformSelfTransforms {
+		transformation.Transform(this_doc, nil)
+	}
+
+	html, err := this_doc.Html()
+	if err != nil {
+		return err
+	}
+
+	if mode == StreamInOrder {
+		return page.streamInOrder(w, flush, html, results, pending)
+	}
+
+	return page.streamOutOfOrder(w, flush, html, results, pending)
+}
+
+func (page *FragmentedPage) streamOutOfOrder(w io.Writer, flush func(), html string,
+	results chan streamedFragment, pending map[int]bool) error {
+
+	// Everything up to the end of the body goes now, the fragments follow it
+	tail := ""
+	if i := strings.LastIndex(html, "</body>"); i >= 0 && len(pending) > 0 {
+		html, tail = html[:i], html[i:]
+	}
+
+	if _, err := io.WriteString(w, html); err != nil {
+		return err
+	}
+
+	if len(pending) > 0 {
+		io.WriteString(w, streamSwapScript)
+	}
+	flush()
+
+	for len(pending) > 0 {
+		result := <-results
+		delete(pending, result.index)
+
+		if result.err != nil {
+			continue
+		}
+
+		for id, replacement := range page.streamedReplacements(result) {
+			// Escaped (<, > and & included) so that nothing in it is markup
+			markup, _ := json.Marshal(replacement)
+			if _, err := fmt.Fprintf(w, `<script>stitchSwap("%s",%s)</script>`, id, markup); err != nil {
+				return err
+			}
+		}
+		flush()
+	}
+
+	_, err := io.WriteString(w, tail)
+	return err
+}
+
+func (page *FragmentedPage) streamInOrder(w io.Writer, flush func(), html string,
+	results chan streamedFragment, pending map[int]bool) error {
+
+	replacements := make(map[string]string)
+	failed := make(map[int]bool)
+
+	for {
+		start := strings.Index(html, "<!--stitch-pending:")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(html[start:], "-->") + start
+
+		if _, err := io.WriteString(w, html[:start]); err != nil {
+			return err
+		}
+
+		id := html[start+len("<!--stitch-pending:") : end]
+		html = html[end+len("-->"):]
+
+		var index int
+		fmt.Sscanf(id, "%d-", &index)
+
+		// Wait for (and flush) fragments until this one's in
+		flush()
+		for pending[index] {
+			result := <-results
+			delete(pending, result.index)
+
+			if result.err != nil {
+				failed[result.index] = true
+				continue
+			}
+
+			for id, replacement := range page.streamedReplacements(result) {
+				replacements[id] = replacement
+			}
+		}
+
+		if !failed[index] {
+			if _, err := io.WriteString(w, replacements[id]); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := io.WriteString(w, html)
+	return err
+}
+
+// awaitingUnstreamable returns true if any of the pending fragments has a
+// transform other than a (streamable) replace
+func (page *FragmentedPage) awaitingUnstreamable(pending map[int]bool) bool {
+	for i := range pending {
+		for _, transformation := range page.Fragment.Fragments[i].DocumentTransforms {
+			if transformation.Type != "replace" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyStreamed transforms the page with a fragment that arrived before the first flush
+func (page *FragmentedPage) applyStreamed(this_doc *goquery.Document, result streamedFragment) {
+	child_doc, err := goquery.NewDocumentFromReader(strings.NewReader(result.content))
+	if err != nil {
+		return
+	}
+
+	for _, transformation := range page.Fragment.Fragments[result.index].DocumentTransforms {
+		transformation.Transform(this_doc, child_doc)
+	}
+}
+
+// streamedReplacements returns the markup for each of a fragment's (replace)
+// transforms, keyed by placeholder id
+func (page *FragmentedPage) streamedReplacements(result streamedFragment) map[string]string {
+	replacements := make(map[string]string)
+
+	child_doc, err := goquery.NewDocumentFromReader(strings.NewReader(result.content))
+	if err != nil {
+		return replacements
+	}
+
+	for j, transformation := range page.Fragment.Fragments[result.index].DocumentTransforms {
+		if transformation.Type != "replace" || transformation.ParentSelector == "" {
+			continue
+		}
+
+		html, err := transformation.PartialHtml(child_doc)
+		if err != nil {
+			continue
+		}
+		replacements[fmt.Sprintf("%d-%d", result.index, j)] = html
+	}
+
+	return replacements
+}
@@ -0,0 +1,105 @@
+package stitcher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newStreamingHost returns a host whose page streams (in mode) a fragment
+// from a backend that takes longer than StreamFlushAfter
+func newStreamingHost(t *testing.T, mode string, content string, transforms []DocumentTransform) *Stitcherd {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte(content))
+	}))
+	t.Cleanup(backend.Close)
+
+	stitcherd := (&Stitcherd{}).Init()
+
+	host := &Host{
+		Hostname: "stream.test",
+		Routes: []Route{{
+			Path:             "/",
+			RespondWith:      "fragmented_page",
+			Stream:           mode,
+			StreamFlushAfter: "10ms",
+			Page: &FragmentedPage{Fragment: Fragment{
+				Fetcher: FragmentFetcher{Source: `<html><body><p>before</p><div id="slow">loading</div><p>after</p></body></html>`},
+				Fragments: []Fragment{{
+					Name:               "slow",
+					Fetcher:            FragmentFetcher{Type: "uri", Source: backend.URL + "/"},
+					DocumentTransforms: transforms,
+				}},
+			}},
+		}},
+	}
+	host.Init()
+	stitcherd.SetHost(host)
+
+	return stitcherd
+}
+
+func streamPage(stitcherd *Stitcherd) string {
+	recorder := httptest.NewRecorder()
+	stitcherd.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://stream.test/", nil))
+	return recorder.Body.String()
+}
+
+func TestStreamOutOfOrderLateFragment(t *testing.T) {
+	replace := []DocumentTransform{{Type: "replace", ParentSelector: "#slow"}}
+
+	body := streamPage(newStreamingHost(t, StreamOutOfOrder, `<div id="slow">in stock</div>`, replace))
+
+	// The page, with the insertion point marked, then the fragment
+	page := strings.Index(body, `<div id="slow" data-stitch-pending="0-0">loading</div><p>after</p>`)
+	swap := strings.Index(body, `<script>stitchSwap("0-0","\u003cdiv id=\"slow\"\u003ein stock\u003c/div\u003e")</script>`)
+	end := strings.Index(body, "</body>")
+
+	if page < 0 || swap < 0 || !(page < swap && swap < end) {
+		t.Errorf("unexpected streamed page %q", body)
+	}
+}
+
+func TestStreamOutOfOrderEscaped(t *testing.T) {
+	replace := []DocumentTransform{{Type: "replace", ParentSelector: "#slow"}}
+
+	// Markup that would end a template or script it was put in
+	body := streamPage(newStreamingHost(t, StreamOutOfOrder, `<div id="slow"><code>&lt;/template&gt;</code><script>var s = "</template></script>";</script></div>`, replace))
+
+	swap := body[strings.Index(body, `<script>stitchSwap(`):]
+	if script := swap[len("<script>"):strings.Index(swap, "</script>")]; strings.ContainsAny(script, "<>") {
+		t.Errorf("streamed markup not escaped: %q", script)
+	}
+	if strings.Contains(body, "<template") {
+		t.Errorf("streamed in a template: %q", body)
+	}
+}
+
+func TestStreamInOrderLateFragment(t *testing.T) {
+	replace := []DocumentTransform{{Type: "replace", ParentSelector: "#slow"}}
+
+	body := streamPage(newStreamingHost(t, StreamInOrder, `<div id="slow">in stock</div>`, replace))
+
+	if !strings.Contains(body, `<p>before</p><div id="slow">in stock</div><p>after</p>`) || strings.Contains(body, "stitch") {
+		t.Errorf("unexpected streamed page %q", body)
+	}
+}
+
+func TestStreamWaitsForUnstreamableFragment(t *testing.T) {
+	// Not a replace, so it can't be swapped in later
+	transforms := []DocumentTransform{
+		{Type: "replace", ParentSelector: "#slow"},
+		{Type: "set_class", ParentSelector: "#slow", Classname: "ready"},
+	}
+
+	for _, mode := range []string{StreamOutOfOrder, StreamInOrder} {
+		body := streamPage(newStreamingHost(t, mode, `<div id="slow">in stock</div>`, transforms))
+
+		if !strings.Contains(body, `<p>before</p><div id="slow">in stock</div><p>after</p>`) || strings.Contains(body, "stitch") {
+			t.Errorf("%s: fragment not waited for: %q", mode, body)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package stitcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/sprig"
+	"github.com/PaesslerAG/gval"
+	"github.com/PaesslerAG/jsonpath"
+	"github.com/bradfitz/iter"
+	"github.com/goodsign/monday"
+	"github.com/microcosm-cc/bluemonday"
+	"golang.org/x/text/currency"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// Policy used by the sanitize and markdown template funcs
+var sanitizePolicy = bluemonday.UGCPolicy()
+
+// JSONPath with gval's operators, for filters like [?(@.stock > 0)]
+var jsonPathLanguage = gval.Full(jsonpath.Language())
+
+// TemplateFuncs returns the functions available to fetcher templates: sprig's
+// generic functions plus stitcherd's own.
+func TemplateFuncs() template.FuncMap {
+	funcs := sprig.GenericFuncMap()
+
+	funcs["N"] = iter.N
+	funcs["unescape"] = unescape
+
+	funcs["buildURL"] = buildURL
+	funcs["sanitize"] = sanitize
+	funcs["markdown"] = markdown
+	funcs["money"] = money
+	funcs["localDate"] = localDate
+	funcs["jsonPath"] = jsonPath
+
+	return template.FuncMap(funcs)
+}
+
+func unescape(s string) template.HTML {
+	return template.HTML(s)
+}
+
+// buildURL appends key/value pairs as query parameters to base, eg
+// {{ buildURL "/users" "id" .json.id "page" 2 }}
+func buildURL(base string, pairs ...interface{}) (string, error) {
+	if len(pairs)%2 != 0 {
+		return "", fmt.Errorf("buildURL: odd number of key/value arguments")
+	}
+
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+
+	query := u.Query()
+	for i := 0; i < len(pairs); i += 2 {
+		query.Add(fmt.Sprint(pairs[i]), fmt.Sprint(pairs[i+1]))
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// sanitize strips anything unsafe (scripts, event handlers etc) from s
+func sanitize(s string) template.HTML {
+	return template.HTML(sanitizePolicy.Sanitize(s))
+}
+
+// markdown converts s to sanitized HTML
+func markdown(s string) (template.HTML, error) {
+	var buffer bytes.Buffer
+
+	// Sanitized below, so raw HTML can be let through to it
+	if err := NewMarkdown("", true).Convert([]byte(s), &buffer); err != nil {
+		return "", err
+	}
+
+	return template.HTML(sanitizePolicy.SanitizeBytes(buffer.Bytes())), nil
+}
+
+// money formats amount in the ISO 4217 currency code for locale, eg
+// {{ money .json.price "EUR" "fr-FR" }} => € 1 234,50
+func money(amount interface{}, code string, locale string) (string, error) {
+	value, err := toFloat(amount)
+	if err != nil {
+		return "", err
+	}
+
+	unit, err := currency.ParseISO(code)
+	if err != nil {
+		return "", err
+	}
+
+	tag, err := language.Parse(locale)
+	if err != nil {
+		return "", fmt.Errorf("money: invalid locale '%s': %v", locale, err)
+	}
+
+	printer := message.NewPrinter(tag)
+
+	return printer.Sprint(currency.Symbol(unit.Amount(value))), nil
+}
+
+// localDate formats value (a time.Time, RFC3339 string or unix seconds)
+// with a Go time layout, translating day and month names for locale, eg
+// {{ localDate "Monday 2 January 2006" .json.date "fr-FR" }}
+func localDate(layout string, value interface{}, locale string) (string, error) {
+	var t time.Time
+
+	switch v := value.(type) {
+	case time.Time:
+		t = v
+	case string:
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return "", err
+		}
+		t = parsed
+	default:
+		seconds, err := toFloat(v)
+		if err != nil {
+			return "", err
+		}
+		t = time.Unix(int64(seconds), 0)
+	}
+
+	dateLocale, err := mondayLocale(locale)
+	if err != nil {
+		return "", err
+	}
+
+	return monday.Format(t, layout, dateLocale), nil
+}
+
+// mondayLocale returns the supported locale for locale, eg "fr-CA" =>
+// fr_CA, or for a bare language its likely region, eg "de" => de_DE.  Failing
+// that any locale of the language is used, eg "fr-BE" => fr_FR, and failing
+// that it's an error (not English).
+func mondayLocale(locale string) (monday.Locale, error) {
+	tag, err := language.Parse(locale)
+	if err != nil {
+		return "", fmt.Errorf("localDate: invalid locale '%s': %v", locale, err)
+	}
+
+	base, _ := tag.Base()
+	region, _ := tag.Region()
+
+	supported := monday.ListLocales()
+
+	for _, candidate := range supported {
+		if string(candidate) == base.String()+"_"+region.String() {
+			return candidate, nil
+		}
+	}
+
+	for _, candidate := range supported {
+		if strings.HasPrefix(string(candidate), base.String()+"_") {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("localDate: unsupported locale '%s'", locale)
+}
+
+// jsonPath queries data (typically .json) with a JSONPath expression, eg
+// {{ range jsonPath "$.items[?(@.stock > 0)].name" .json }}
+func jsonPath(path string, data interface{}) (interface{}, error) {
+	return jsonPathLanguage.Evaluate(path, data)
+}
+
+func toFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case int32:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case uint:
+		return float64(v), nil
+	case uint32:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case json.Number:
+		return v.Float64()
+	case string:
+		return strconv.ParseFloat(v, 64)
+	}
+
+	return 0, fmt.Errorf("unable to convert %#v to a number", value)
+}
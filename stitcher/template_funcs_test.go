@@ -0,0 +1,144 @@
+package stitcher
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMoney(t *testing.T) {
+	tests := []struct {
+		amount  interface{}
+		code    string
+		locale  string
+		want    string
+		wantErr bool
+	}{
+		{1234.5, "EUR", "en-US", "€ 1,234.50", false},
+		{1234.5, "EUR", "fr-FR", "€ 1\u00a0234,50", false},
+		{1234.5, "EUR", "de", "€ 1.234,50", false},
+		{int32(12), "USD", "en-US", "$ 12.00", false},
+		{json.Number("9.99"), "GBP", "en-GB", "£ 9.99", false},
+		{"3", "EUR", "en", "€ 3.00", false},
+		{1.0, "XXXX", "en-US", "", true},
+		{1.0, "EUR", "not a locale", "", true},
+		{"lots", "EUR", "en-US", "", true},
+		{[]int{1}, "EUR", "en-US", "", true},
+	}
+
+	for _, test := range tests {
+		got, err := money(test.amount, test.code, test.locale)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("money(%#v, %q, %q) = %q, %v, want %q", test.amount, test.code, test.locale, got, err, test.want)
+		}
+	}
+}
+
+func TestLocalDate(t *testing.T) {
+	date := time.Date(2024, 3, 4, 9, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		value   interface{}
+		locale  string
+		want    string
+		wantErr bool
+	}{
+		{date, "en-US", "Monday 4 March 2024", false},
+		{date, "fr-FR", "lundi 4 mars 2024", false},
+		{date, "de", "Montag 4 März 2024", false},
+		{date, "fr-BE", "lundi 4 mars 2024", false},
+		{"2024-03-04T09:30:00Z", "de-DE", "Montag 4 März 2024", false},
+		{int64(date.Unix()), "en-GB", "Monday 4 March 2024", false},
+		{json.Number("1709544600"), "en", "Monday 4 March 2024", false},
+		{"4 March 2024", "en-US", "", true},
+		{date, "not a locale", "", true},
+		{date, "zu", "", true},
+	}
+
+	for _, test := range tests {
+		got, err := localDate("Monday 2 January 2006", test.value, test.locale)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("localDate(%#v, %q) = %q, %v, want %q", test.value, test.locale, got, err, test.want)
+		}
+	}
+}
+
+func TestJSONPath(t *testing.T) {
+	var data interface{}
+	if err := json.Unmarshal([]byte(`{"items": [{"name": "a", "stock": 2}, {"name": "b", "stock": 0}], "total": 2}`), &data); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path    string
+		want    interface{}
+		wantErr bool
+	}{
+		{"$.total", 2.0, false},
+		{"$.items[*].name", []interface{}{"a", "b"}, false},
+		{"$.items[?(@.stock > 0)].name", []interface{}{"a"}, false},
+		{"$.missing", nil, true},
+		{"$.items[", nil, true},
+	}
+
+	for _, test := range tests {
+		got, err := jsonPath(test.path, data)
+		if (err != nil) != test.wantErr || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("jsonPath(%q) = %#v, %v, want %#v", test.path, got, err, test.want)
+		}
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		html string
+		want string
+	}{
+		{`<p>Hello <b>there</b></p>`, `<p>Hello <b>there</b></p>`},
+		{`<p onclick="steal()">hi</p>`, `<p>hi</p>`},
+		{`<script>steal()</script>ok`, `ok`},
+		{`<a href="javascript:steal()">link</a>`, `link`},
+		{`<a href="https://example.com/">link</a>`, `<a href="https://example.com/" rel="nofollow">link</a>`},
+	}
+
+	for _, test := range tests {
+		if got := string(sanitize(test.html)); got != test.want {
+			t.Errorf("sanitize(%q) = %q, want %q", test.html, got, test.want)
+		}
+	}
+}
+
+func TestBuildURL(t *testing.T) {
+	tests := []struct {
+		base    string
+		pairs   []interface{}
+		want    string
+		wantErr bool
+	}{
+		{"/users", []interface{}{"id", 5}, "/users?id=5", false},
+		{"/users?a=1", []interface{}{"q", "a b&c"}, "/users?a=1&q=a+b%26c", false},
+		{"https://example.com/search", []interface{}{"tag", "x", "tag", "y"}, "https://example.com/search?tag=x&tag=y", false},
+		{"/users", nil, "/users", false},
+		{"/users", []interface{}{"id"}, "", true},
+		{"%zz", []interface{}{"id", 1}, "", true},
+	}
+
+	for _, test := range tests {
+		got, err := buildURL(test.base, test.pairs...)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("buildURL(%q, %v) = %q, %v, want %q", test.base, test.pairs, got, err, test.want)
+		}
+	}
+}
+
+func TestTemplateFuncsAvailable(t *testing.T) {
+	funcs := TemplateFuncs()
+
+	for _, name := range strings.Fields("N unescape buildURL sanitize markdown money localDate jsonPath") {
+		if funcs[name] == nil {
+			t.Errorf("%s missing", name)
+		}
+	}
+}
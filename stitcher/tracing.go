@@ -0,0 +1,183 @@
+package stitcher
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Trace exporters for TracingOptions.Exporter
+const (
+	TraceExporterOTLP   = "otlp"   // OTLP over HTTP, to Endpoint or $OTEL_EXPORTER_OTLP_ENDPOINT
+	TraceExporterStdout = "stdout" // Pretty printed JSON on stdout
+	TraceExporterFile   = "file"   // JSON lines appended to File
+)
+
+// TracingOptions configures exporting the request traces
+type TracingOptions struct {
+	Exporter string // Blank for no exporter (requests still get trace ids)
+	Endpoint string // Eg "http://localhost:4318", for otlp
+	File     string // For file
+}
+
+const tracerName = "github.com/vhodges/stitcherd/stitcher"
+
+var tracer = otel.Tracer(tracerName)
+
+var shutdownTracing = func(ctx context.Context) error { return nil }
+
+// InitTracing installs the tracer provider and the W3C trace context propagator.
+// Without an exporter spans aren't recorded, but requests still get (or
+// continue) a trace id.
+func InitTracing(options TracingOptions) error {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var exporter sdktrace.SpanExporter
+	var err error
+
+	switch options.Exporter {
+	case "":
+	case TraceExporterOTLP:
+		var opts []otlptracehttp.Option
+		if options.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(options.Endpoint))
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	case TraceExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case TraceExporterFile:
+		var file io.Writer
+		file, err = os.OpenFile(options.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err == nil {
+			exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+		}
+	default:
+		err = fmt.Errorf("unknown trace exporter '%s'", options.Exporter)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	res, err := resource.Merge(resource.Default(),
+		resource.NewSchemaless(attribute.String("service.name", "stitcherd")))
+	if err != nil {
+		return err
+	}
+
+	opts := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+	if exporter != nil {
+		opts = append(opts, sdktrace.WithBatcher(exporter),
+			sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.AlwaysSample())))
+	} else {
+		opts = append(opts, sdktrace.WithSampler(sdktrace.NeverSample()))
+	}
+
+	provider := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(provider)
+	shutdownTracing = provider.Shutdown
+
+	// The global provider only delegates to the first one set
+	tracer = provider.Tracer(tracerName)
+
+	if exporter != nil {
+		slog.Info("Tracing", "exporter", options.Exporter)
+	}
+
+	return nil
+}
+
+// startRequestSpan starts the span of a request, continuing the trace of its traceparent header (if any)
+func startRequestSpan(r *http.Request) (*http.Request, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+	ctx, span := tracer.Start(ctx, r.Method+" "+r.Host, trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("server.address", r.Host),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String("user_agent.original", r.UserAgent()),
+		))
+
+	return r.WithContext(ctx), span
+}
+
+// endRequestSpan ends a request's span with its status
+func endRequestSpan(span trace.Span, status int) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
+
+// requestTraceID returns the trace id of the request, if it has one
+func requestTraceID(r *http.Request) string {
+	spanContext := trace.SpanContextFromContext(r.Context())
+	if !spanContext.HasTraceID() {
+		return ""
+	}
+	return spanContext.TraceID().String()
+}
+
+// traceContext returns the (Go) context of the current span in the fetch context
+func traceContext(contextdata map[string]interface{}) context.Context {
+	if ctx, ok := contextdata["_trace"].(context.Context); ok {
+		return ctx
+	}
+	return context.Background()
+}
+
+// startSpan starts a child of the current span in the fetch context.  When the
+// span is recorded the returned fetch context is a copy, holding the new span
+// for its own children, otherwise it is contextdata.
+func startSpan(contextdata map[string]interface{}, name string, attributes ...attribute.KeyValue) (map[string]interface{}, trace.Span) {
+	ctx, span := tracer.Start(traceContext(contextdata), name, trace.WithAttributes(attributes...))
+
+	if !span.IsRecording() {
+		return contextdata, span
+	}
+
+	spanContext := copyContext(contextdata)
+	spanContext["_trace"] = ctx
+
+	return spanContext, span
+}
+
+// endSpan ends span, recording err (if any)
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// injectTraceContext adds the traceparent of the current span to a backend request
+func injectTraceContext(req *http.Request, contextdata map[string]interface{}) {
+	otel.GetTextMapPropagator().Inject(traceContext(contextdata), propagation.HeaderCarrier(req.Header))
+}
+
+func fragmentName(fragment *Fragment) string {
+	if fragment.Name == "" {
+		return "unnamed"
+	}
+	return fragment.Name
+}
@@ -0,0 +1,152 @@
+package stitcher
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// exportedSpan is the part of a span, as written by the file exporter, the tests check
+type exportedSpan struct {
+	Name        string
+	SpanContext struct{ TraceID, SpanID string }
+	Parent      struct{ TraceID, SpanID string }
+	Attributes  []struct {
+		Key   string
+		Value struct{ Value interface{} }
+	}
+	Status struct{ Code string }
+}
+
+func (span *exportedSpan) attribute(key string) interface{} {
+	for _, attribute := range span.Attributes {
+		if attribute.Key == key {
+			return attribute.Value.Value
+		}
+	}
+	return nil
+}
+
+// readSpans flushes the spans to the file and returns them
+func readSpans(t *testing.T, file string) []exportedSpan {
+	if err := shutdownTracing(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var spans []exportedSpan
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var span exportedSpan
+		if err := json.Unmarshal(scanner.Bytes(), &span); err != nil {
+			t.Fatalf("invalid span %q: %v", scanner.Text(), err)
+		}
+		spans = append(spans, span)
+	}
+
+	return spans
+}
+
+// findSpan returns the span with name (and fragment.name, if given)
+func findSpan(t *testing.T, spans []exportedSpan, name string, fragment string) exportedSpan {
+	for _, span := range spans {
+		if span.Name == name && (fragment == "" || span.attribute("fragment.name") == fragment) {
+			return span
+		}
+	}
+
+	t.Fatalf("no %s span (fragment %q) in %+v", name, fragment, spans)
+	return exportedSpan{}
+}
+
+func TestTracingSpans(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "spans.json")
+	t.Cleanup(func() { InitTracing(TracingOptions{}) })
+
+	var backendTraceparent string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendTraceparent = r.Header.Get("traceparent")
+		w.Write([]byte("<p>cart</p>"))
+	}))
+	defer backend.Close()
+
+	stitcherd := (&Stitcherd{Tracing: TracingOptions{Exporter: TraceExporterFile, File: file}}).Init()
+
+	host := &Host{
+		Hostname: "tracing.test",
+		Routes: []Route{{
+			Path:        "/",
+			RespondWith: "fragmented_page",
+			Page: &FragmentedPage{Fragment: Fragment{
+				Name:    "page",
+				Fetcher: FragmentFetcher{Source: `<div id="cart"></div>`},
+				Fragments: []Fragment{{
+					Name:               "cart",
+					Fetcher:            FragmentFetcher{Type: "uri", Source: backend.URL + "/cart"},
+					DocumentTransforms: []DocumentTransform{{Type: "replace", ParentSelector: "#cart"}},
+				}},
+			}},
+		}},
+	}
+	host.Init()
+	stitcherd.SetHost(host)
+
+	// Continuing the caller's trace
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	request := httptest.NewRequest(http.MethodGet, "http://tracing.test/", nil)
+	request.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+
+	recorder := httptest.NewRecorder()
+	stitcherd.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "cart") {
+		t.Fatalf("status %d, body %q", recorder.Code, recorder.Body.String())
+	}
+
+	spans := readSpans(t, file)
+
+	server := findSpan(t, spans, "GET tracing.test", "")
+	if server.Parent.SpanID != "00f067aa0ba902b7" {
+		t.Errorf("request span's parent %q, want the caller's span", server.Parent.SpanID)
+	}
+	if status := server.attribute("http.response.status_code"); status != float64(http.StatusOK) {
+		t.Errorf("request span status code %v", status)
+	}
+
+	for _, span := range spans {
+		if span.SpanContext.TraceID != traceID {
+			t.Errorf("%s: trace %s, want %s", span.Name, span.SpanContext.TraceID, traceID)
+		}
+	}
+
+	page := findSpan(t, spans, "fragment.render", "page")
+	cart := findSpan(t, spans, "fragment.render", "cart")
+	if cart.Parent.SpanID != page.SpanContext.SpanID {
+		t.Errorf("cart render span's parent %q, want the page's %q", cart.Parent.SpanID, page.SpanContext.SpanID)
+	}
+
+	fetch := findSpan(t, spans, "fragment.fetch", "cart")
+	if fetch.Parent.SpanID != cart.SpanContext.SpanID {
+		t.Errorf("cart fetch span's parent %q, want its render span %q", fetch.Parent.SpanID, cart.SpanContext.SpanID)
+	}
+	if fetch.attribute("fetcher.type") != "uri" || fetch.Status.Code == "Error" {
+		t.Errorf("cart fetch span %+v", fetch)
+	}
+
+	// The backend continues the trace from the fetch
+	if want := "00-" + traceID + "-" + fetch.SpanContext.SpanID + "-01"; backendTraceparent != want {
+		t.Errorf("backend traceparent %q, want %q", backendTraceparent, want)
+	}
+}
@@ -2,8 +2,8 @@
 package stitcher
 
 import (
-	"log"
 	"github.com/PuerkitoBio/goquery"
+	"log/slog"
 )
 
 type DocumentTransform struct {
@@ -25,22 +25,12 @@ func (transform *DocumentTransform) Transform(parent_doc *goquery.Document, chil
 
 		replaceAt := parent_doc.Find(transform.ParentSelector)
 
-		if transform.ChildSelector != "" {
-			replaceWith := child_doc.Find(transform.ChildSelector)
-			html, err := replaceWith.Html()
-			if err != nil {
-				log.Printf("err: '%v'\n", err)
-				return
-			}
-			replaceAt.ReplaceWithHtml(html)
-		} else {
-			html, err := child_doc.Html()
-			if err != nil {
-				log.Printf("err: '%v'\n", err)
-				return
-			}
-			replaceAt.ReplaceWithHtml(html)
+		html, err := transform.ReplacementHtml(child_doc)
+		if err != nil {
+			slog.Error("Error replacing", "selector", transform.ParentSelector, "error", err)
+			return
 		}
+		replaceAt.ReplaceWithHtml(html)
 	case "set_class":
 		if parent_doc == nil || transform.ParentSelector == "" || transform.Classname == "" {
 			return
@@ -49,3 +39,20 @@ func (transform *DocumentTransform) Transform(parent_doc *goquery.Document, chil
 	default:
 	}
 }
+
+// ReplacementHtml returns the markup a "replace" transform inserts from child_doc
+func (transform *DocumentTransform) ReplacementHtml(child_doc *goquery.Document) (string, error) {
+	if transform.ChildSelector != "" {
+		return child_doc.Find(transform.ChildSelector).Html()
+	}
+	return child_doc.Html()
+}
+
+// PartialHtml is ReplacementHtml for markup sent separately from the page it
+// goes into (ie just the body's content rather than a whole document)
+func (transform *DocumentTransform) PartialHtml(child_doc *goquery.Document) (string, error) {
+	if transform.ChildSelector != "" {
+		return child_doc.Find(transform.ChildSelector).Html()
+	}
+	return child_doc.Find("body").Html()
+}
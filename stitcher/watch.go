@@ -0,0 +1,395 @@
+package stitcher
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// End points for reloading browsers, served for any Host with Watch.LiveReload
+const (
+	ReloadPath       = "/_stitcherd/reload"
+	ReloadScriptPath = "/_stitcherd/reload.js"
+)
+
+const defaultWatchDebounce = 250 * time.Millisecond
+
+// Reloads the page when stitcherd says so
+const reloadScript = `(function(){
+var source=new EventSource("` + ReloadPath + `");
+source.addEventListener("reload",function(){location.reload()});
+})();
+`
+
+// WatchOptions reloads hosts when their config, or the files it refers to,
+// change.  Meant for development.
+type WatchOptions struct {
+	Enabled  bool
+	Debounce time.Duration // How long to wait for changes to settle, defaults to 250ms
+
+	// Reload pages including the ReloadScriptPath script once their host
+	// reloads (or a file in one of its static_content directories changes)
+	LiveReload bool
+}
+
+// hostWatcher reloads the host files whose watched files change
+type hostWatcher struct {
+	stitcherd *Stitcherd
+	watcher   *fsnotify.Watcher
+
+	files       map[string][]string // Watched file -> the host files referring to it
+	staticDirs  []string
+	directories map[string]bool // Being watched
+}
+
+// isReloadPath returns true for the live reload end points
+func isReloadPath(path string) bool {
+	return path == ReloadPath || path == ReloadScriptPath
+}
+
+// watch starts reloading hosts as their files change, until closed
+func (stitcherd *Stitcherd) watch() (io.Closer, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	if stitcherd.Watch.LiveReload {
+		stitcherd.reloads = &reloadBroker{clients: make(map[chan struct{}]bool)}
+	}
+
+	w := &hostWatcher{
+		stitcherd:   stitcherd,
+		watcher:     watcher,
+		directories: make(map[string]bool),
+	}
+	w.update()
+
+	go w.run()
+
+	slog.Info("Watching host files", "files", len(w.files), "live_reload", stitcherd.Watch.LiveReload)
+
+	return watcher, nil
+}
+
+// run collects changes until they settle, then reloads the affected hosts
+func (w *hostWatcher) run() {
+	debounce := w.stitcherd.Watch.Debounce
+	if debounce <= 0 {
+		debounce = defaultWatchDebounce
+	}
+
+	pending := make(map[string]bool)
+	reloadBrowsers := false
+
+	var settled <-chan time.Time
+
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+
+			name, err := filepath.Abs(event.Name)
+			if err != nil {
+				continue
+			}
+
+			if hostFiles, ok := w.files[name]; ok {
+				for _, file := range hostFiles {
+					pending[file] = true
+				}
+			} else if w.inStaticDir(name) {
+				reloadBrowsers = true
+			} else {
+				continue
+			}
+
+			slog.Debug("Watched file changed", "file", name, "op", event.Op.String())
+			settled = time.After(debounce)
+
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			slog.Warn("Watching host files", "error", err)
+
+		case <-settled:
+			settled = nil
+
+			if len(pending) > 0 && w.reload(pending) > 0 {
+				reloadBrowsers = true
+			}
+			if reloadBrowsers && w.stitcherd.reloads != nil {
+				w.stitcherd.reloads.notify()
+			}
+
+			pending = make(map[string]bool)
+			reloadBrowsers = false
+		}
+	}
+}
+
+// reload reloads the host files, returning how many loaded.  Failures are
+// logged (by load) and leave the current host in place.
+func (w *hostWatcher) reload(pending map[string]bool) int {
+	files := make([]string, 0, len(pending))
+	for file := range pending {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	slog.Info("Reloading changed host files", "files", files)
+
+	// Templates and file sources are read as fragments render, but what's
+	// already cached wouldn't change.  Start the hosts with empty caches.
+	failed := w.stitcherd.load(files, true)
+
+	// The hosts may refer to different files now
+	w.update()
+
+	return len(files) - len(failed)
+}
+
+// update watches the host files and the files their current hosts refer to
+func (w *hostWatcher) update() {
+	files := make(map[string][]string)
+	var staticDirs []string
+
+	add := func(hostFile string, path string) {
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return
+		}
+		files[path] = append(files[path], hostFile)
+		w.add(filepath.Dir(path))
+	}
+
+	w.stitcherd.hostsLock.RLock()
+	hostFiles := append([]string(nil), w.stitcherd.hostConfigFiles...)
+	w.stitcherd.hostsLock.RUnlock()
+
+	for _, file := range hostFiles {
+		add(file, file)
+
+		host := w.stitcherd.fileHost(file)
+		if host == nil {
+			continue
+		}
+
+		for _, path := range host.referencedFiles() {
+			add(file, path)
+		}
+
+		for _, dir := range host.staticDirs() {
+			if dir, err := filepath.Abs(dir); err == nil {
+				staticDirs = append(staticDirs, dir)
+				w.addTree(dir)
+			}
+		}
+	}
+
+	w.files = files
+	w.staticDirs = staticDirs
+}
+
+// add watches dir (file watches are lost when editors replace the file)
+func (w *hostWatcher) add(dir string) {
+	if w.directories[dir] {
+		return
+	}
+
+	if err := w.watcher.Add(dir); err != nil {
+		slog.Warn("Can't watch directory", "directory", dir, "error", err)
+		return
+	}
+	w.directories[dir] = true
+}
+
+// addTree watches dir and its subdirectories
+func (w *hostWatcher) addTree(dir string) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			w.add(path)
+		}
+		return nil
+	})
+}
+
+func (w *hostWatcher) inStaticDir(name string) bool {
+	for _, dir := range w.staticDirs {
+		if strings.HasPrefix(name, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// referencedFiles returns the files the host reads when it's loaded or its
+// pages render (where the paths aren't interpolated)
+func (host *Host) referencedFiles() []string {
+	var files []string
+
+	if host.Auth != nil {
+		if host.Auth.Htpasswd != "" {
+			files = append(files, host.Auth.Htpasswd)
+		}
+		if host.Auth.Htgroup != "" {
+			files = append(files, host.Auth.Htgroup)
+		}
+	}
+
+	for _, route := range host.Routes {
+		if route.RouteDataFragment != nil {
+			files = append(files, route.RouteDataFragment.referencedFiles()...)
+		}
+		if route.Page != nil {
+			files = append(files, route.Page.Fragment.referencedFiles()...)
+		}
+	}
+
+	return files
+}
+
+// staticDirs returns the directories served by the host's static_content routes
+func (host *Host) staticDirs() []string {
+	var dirs []string
+	for _, route := range host.Routes {
+		if route.RespondWith == "static_content" && route.StaticPath != "" {
+			dirs = append(dirs, route.StaticPath)
+		}
+	}
+	return dirs
+}
+
+// referencedFiles returns the fragment's (and its descendants') template and file sources
+func (fragment *Fragment) referencedFiles() []string {
+	var files []string
+
+	if fragment.Fetcher.Template != "" {
+		files = append(files, fragment.Fetcher.Template)
+	}
+
+	if fragment.Fetcher.Type == "file" && !strings.Contains(fragment.Fetcher.Source, "{{") {
+		files = append(files, fragment.Fetcher.Source)
+	}
+
+	for i := range fragment.Fragments {
+		files = append(files, fragment.Fragments[i].referencedFiles()...)
+	}
+
+	return files
+}
+
+// reloadBroker tells open pages to reload
+type reloadBroker struct {
+	lock    sync.Mutex
+	clients map[chan struct{}]bool
+	closed  bool
+}
+
+func (broker *reloadBroker) subscribe() chan struct{} {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+
+	client := make(chan struct{}, 1)
+	if broker.closed {
+		close(client)
+	} else {
+		broker.clients[client] = true
+	}
+	return client
+}
+
+func (broker *reloadBroker) unsubscribe(client chan struct{}) {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+
+	if _, ok := broker.clients[client]; ok {
+		delete(broker.clients, client)
+		close(client)
+	}
+}
+
+func (broker *reloadBroker) notify() {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+
+	for client := range broker.clients {
+		select {
+		case client <- struct{}{}:
+		default: // Already due to reload
+		}
+	}
+}
+
+// close disconnects the pages, eg when shutting down
+func (broker *reloadBroker) close() {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+
+	broker.closed = true
+	for client := range broker.clients {
+		delete(broker.clients, client)
+		close(client)
+	}
+}
+
+// ServeHTTP serves the client script and the reload events
+func (broker *reloadBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == ReloadScriptPath {
+		w.Header().Set("Content-Type", "application/javascript")
+		fmt.Fprint(w, reloadScript)
+		return
+	}
+
+	client := broker.subscribe()
+	defer broker.unsubscribe(client)
+
+	// Pages stay open for as long as they like
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	flush()
+
+	keepAlive := time.NewTicker(liveKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case _, ok := <-client:
+			if !ok {
+				return
+			}
+			fmt.Fprint(w, "event: reload\ndata: {}\n\n")
+			flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package stitcher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/mailgun/groupcache/v2"
+)
+
+func TestWatchReloadEmptiesCacheAfterLoading(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "host.json")
+	write := func(config string) {
+		if err := os.WriteFile(file, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const config = `{"Hostname": "watch.test", "Routes": [{"Path": "/", "RespondWith": "static_content", "StaticPath": "."}]}`
+	write(config)
+
+	stitcherd := (&Stitcherd{}).Init()
+	stitcherd.hostConfigFiles = []string{file}
+	if failed := stitcherd.load([]string{file}, false); len(failed) > 0 {
+		t.Fatal(failed)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	w := &hostWatcher{stitcherd: stitcherd, watcher: watcher, directories: make(map[string]bool)}
+
+	current := stitcherd.hosts.Get("watch.test")
+	cache := current.Cache
+
+	// A broken file keeps the current host, and its cache
+	write(`{"Hostname": "watch.test", "Routes": [`)
+	if loaded := w.reload(map[string]bool{file: true}); loaded != 0 {
+		t.Fatalf("%d hosts loaded from a broken file", loaded)
+	}
+	if stitcherd.hosts.Get("watch.test") != current || groupcache.GetGroup("watch.test") != cache {
+		t.Errorf("failed reload replaced the host's cache")
+	}
+
+	// A good one starts the new host with an empty cache
+	write(config)
+	if loaded := w.reload(map[string]bool{file: true}); loaded != 1 {
+		t.Fatalf("%d hosts loaded", loaded)
+	}
+
+	reloaded := stitcherd.hosts.Get("watch.test")
+	if reloaded == current {
+		t.Fatal("host not replaced")
+	}
+	if reloaded.Cache == cache || groupcache.GetGroup("watch.test") != reloaded.Cache {
+		t.Errorf("reloaded host didn't get a new (registered) cache")
+	}
+	if current.Cache != cache {
+		t.Errorf("replaced host's cache changed")
+	}
+}